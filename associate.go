@@ -1,80 +1,390 @@
 package socks5
 
 import (
+	"container/list"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// defaultUDPPeerIdleTimeout is the idle timeout of UDP peers if none is configured.
+	defaultUDPPeerIdleTimeout = 2 * time.Minute
+)
+
 // UdpPeer records information about a client connection.
 type UdpPeer struct {
-	updateTime int64       // Timestamp of the last processing
-	udpServer  *UdpServer  // The newly created UDP server, can be nil
-	from       net.UDPAddr // The client's address
-	req        *Request    // The request information
-	dst        net.Conn    // The target connection
-	atyp       byte        // The target address type
-	dstAddr    []byte      // The target address
-	dstPort    []byte      // The target port
+	updateTime int64         // Timestamp of the last processing in nanoseconds, accessed atomically
+	udpServer  *UdpServer    // The newly created UDP server, can be nil
+	from       net.UDPAddr   // The client's address
+	req        *Request      // The request information
+	dst        net.Conn      // The target connection
+	atyp       byte          // The target address type
+	dstAddr    []byte        // The target address
+	dstPort    []byte        // The target port
+	key        string        // The key of the peer in its association
+	assoc      *UdpAssociate // The association of the peer, can be nil
+	assocElem  *list.Element // The element of the peer in the LRU list of its association
+	tableElem  *list.Element // The element of the peer in the LRU list of the server
+}
+
+// touch updates the timestamp of the last processing.
+func (u *UdpPeer) touch() {
+	atomic.StoreInt64(&u.updateTime, time.Now().UnixNano())
+}
+
+// lastUsed returns the timestamp of the last processing.
+func (u *UdpPeer) lastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&u.updateTime))
 }
 
 // UdpAssociate manages a collection of UdpPeer instances.
+// It is safe for concurrent use.
+//
+// The association owns its peers and the goroutines started with spawn. CloseAll closes
+// all peers, rejects new ones and signals the goroutines to exit, wait waits for them.
 type UdpAssociate struct {
-	m map[string]*UdpPeer // Map of UdpPeer instances
+	updateTime int64 // Timestamp of the last datagram from or to the client in nanoseconds, accessed atomically
+
+	mu     sync.Mutex
+	m      map[string]*UdpPeer // Map of UdpPeer instances
+	lru    peerLRU             // The peers in order of use
+	max    int                 // Maximum number of peers, 0 if unlimited
+	table  *udpPeerTable       // The peers of the whole server, can be nil
+	closed bool                // Set by CloseAll
+
+	tableMax int // Maximum number of peers of the whole server, 0 if unlimited
+
+	wg   sync.WaitGroup // Goroutines owned by the association
+	done chan struct{}  // Closed by CloseAll
+}
+
+// touch updates the timestamp of the last datagram from or to the client.
+func (ua *UdpAssociate) touch() {
+	atomic.StoreInt64(&ua.updateTime, time.Now().UnixNano())
+}
+
+// lastUsed returns the timestamp of the last datagram from or to the client.
+func (ua *UdpAssociate) lastUsed() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&ua.updateTime))
 }
 
 // Set adds or updates a UdpPeer in the collection.
 func (ua *UdpAssociate) Set(key string, u *UdpPeer) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if old, ok := ua.m[key]; ok {
+		ua.lru.remove(old.assocElem)
+	}
 	ua.m[key] = u
+	u.assocElem = ua.lru.push(u)
 }
 
 // Get retrieves a UdpPeer from the collection.
 func (ua *UdpAssociate) Get(key string) (*UdpPeer, bool) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
 	v, ok := ua.m[key]
 	return v, ok
 }
 
 // Del removes a UdpPeer from the collection.
 func (ua *UdpAssociate) Del(key string) {
-	delete(ua.m, key)
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if u, ok := ua.m[key]; ok {
+		ua.lru.remove(u.assocElem)
+		delete(ua.m, key)
+	}
+}
+
+// Len returns the number of peers in the collection.
+func (ua *UdpAssociate) Len() int {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return len(ua.m)
 }
 
 // CloseAll closes all target connections in the collection.
+// Peers added later are closed immediately, and the goroutines of the association are signaled to exit.
 func (ua *UdpAssociate) CloseAll() {
+	ua.mu.Lock()
+	if !ua.closed {
+		ua.closed = true
+		close(ua.done)
+	}
+	peers := make([]*UdpPeer, 0, len(ua.m))
 	for _, v := range ua.m {
-		v.dst.Close()
+		peers = append(peers, v)
+	}
+	ua.mu.Unlock()
+	for _, v := range peers {
+		ua.remove(v)
+	}
+}
+
+// spawn runs fn in a goroutine owned by the association. fn must return once Done is closed.
+func (ua *UdpAssociate) spawn(fn func()) {
+	ua.wg.Add(1)
+	go func() {
+		defer ua.wg.Done()
+		fn()
+	}()
+}
+
+// Done returns a channel that is closed when the association is closed by CloseAll.
+func (ua *UdpAssociate) Done() <-chan struct{} {
+	return ua.done
+}
+
+// wait waits for the goroutines of the association to exit.
+func (ua *UdpAssociate) wait() {
+	ua.wg.Wait()
+}
+
+// add adds a new peer to the collection. If the association or the server is at its limit,
+// the least recently used peer is evicted to make room. It returns the number of evicted peers.
+// A peer added to a closed association is closed immediately.
+func (ua *UdpAssociate) add(key string, u *UdpPeer) int {
+	u.key = key
+	u.assoc = ua
+	u.touch()
+	var victims []*UdpPeer
+	ua.mu.Lock()
+	if ua.closed {
+		ua.mu.Unlock()
+		u.dst.Close()
+		return 0
+	}
+	if ua.max > 0 && len(ua.m) >= ua.max {
+		if v := ua.lru.evict(); v != nil {
+			delete(ua.m, v.key)
+			victims = append(victims, v)
+		}
+	}
+	ua.m[key] = u
+	u.assocElem = ua.lru.push(u)
+	ua.mu.Unlock()
+	if ua.table != nil {
+		if v := ua.table.add(u, ua.tableMax); v != nil {
+			victims = append(victims, v)
+		}
+	}
+	for _, v := range victims {
+		v.assoc.remove(v)
+	}
+	return len(victims)
+}
+
+// remove closes the target connection of a peer and removes it from the collection and the server.
+// Removing a peer twice has no effect.
+func (ua *UdpAssociate) remove(u *UdpPeer) {
+	ua.mu.Lock()
+	if ua.m[u.key] == u {
+		delete(ua.m, u.key)
+		ua.lru.remove(u.assocElem)
+	}
+	ua.mu.Unlock()
+	if ua.table != nil {
+		ua.table.remove(u)
+	}
+	u.dst.Close()
+}
+
+// expire removes the peers that have been idle for longer than idle and returns their number.
+func (ua *UdpAssociate) expire(idle time.Duration) int {
+	deadline := time.Now().Add(-idle)
+	var idlePeers []*UdpPeer
+	ua.mu.Lock()
+	for _, v := range ua.m {
+		if v.lastUsed().Before(deadline) {
+			idlePeers = append(idlePeers, v)
+		}
+	}
+	ua.mu.Unlock()
+	for _, v := range idlePeers {
+		ua.remove(v)
+	}
+	return len(idlePeers)
+}
+
+// peerLRU is a list of peers in order of use, the least recently used at the back.
+// The zero value is ready to use, it is not safe for concurrent use.
+//
+// Peers are not moved when they are used, since UdpPeer.touch is lock free. Instead, evict moves
+// peers used since they were placed to the front, which keeps eviction amortized O(1).
+type peerLRU struct {
+	l list.List
+}
+
+// peerLRUEntry is an element of a peerLRU.
+type peerLRUEntry struct {
+	peer   *UdpPeer
+	placed int64 // Last use of the peer when it was placed, in nanoseconds
+}
+
+// push adds a peer at the front and returns its element.
+func (q *peerLRU) push(u *UdpPeer) *list.Element {
+	return q.l.PushFront(&peerLRUEntry{peer: u, placed: atomic.LoadInt64(&u.updateTime)})
+}
+
+// remove removes the element of a peer. Removing an element twice or a nil element has no effect.
+func (q *peerLRU) remove(e *list.Element) {
+	if e != nil {
+		q.l.Remove(e)
+	}
+}
+
+// evict removes and returns the least recently used peer, or nil if the list is empty.
+func (q *peerLRU) evict() *UdpPeer {
+	for i := q.l.Len(); i > 0; i-- {
+		e := q.l.Back()
+		entry := e.Value.(*peerLRUEntry)
+		if used := atomic.LoadInt64(&entry.peer.updateTime); used > entry.placed {
+			// Used since it was placed, give it another round
+			entry.placed = used
+			q.l.MoveToFront(e)
+			continue
+		}
+		q.l.Remove(e)
+		return entry.peer
+	}
+	// All peers are in use, evict the one at the back
+	e := q.l.Back()
+	if e == nil {
+		return nil
+	}
+	q.l.Remove(e)
+	return e.Value.(*peerLRUEntry).peer
+}
+
+// udpPeerTable tracks the peers of all associations of a server to enforce Config.UDPMaxPeers.
+// The zero value is ready to use.
+type udpPeerTable struct {
+	mu  sync.Mutex
+	lru peerLRU
+}
+
+// add registers a peer. If the table holds max peers or more, the least recently used peer
+// is unregistered and returned, the caller must remove it from its association.
+func (t *udpPeerTable) add(u *UdpPeer, max int) *UdpPeer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var victim *UdpPeer
+	if max > 0 && t.lru.l.Len() >= max {
+		if victim = t.lru.evict(); victim != nil {
+			victim.tableElem = nil
+		}
+	}
+	u.tableElem = t.lru.push(u)
+	return victim
+}
+
+// remove unregisters a peer.
+func (t *udpPeerTable) remove(u *UdpPeer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lru.remove(u.tableElem)
+	u.tableElem = nil
+}
+
+// len returns the number of registered peers.
+func (t *udpPeerTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lru.l.Len()
+}
+
+// udpSourceFilter restricts the source of the datagrams accepted by a UDP association
+// to the client of the association, as required by RFC 1928 section 7.
+// It is safe for concurrent use.
+type udpSourceFilter struct {
+	mu   sync.Mutex
+	ip   net.IP // The expected client IP, nil until learned
+	port int    // The expected client port, 0 until learned
+}
+
+// newUdpSourceFilter creates the source filter of an association.
+// The client announces the address it sends datagrams from in DST.ADDR and DST.PORT of the request,
+// and uses zeros if it does not know them. An unknown IP defaults to the IP of the control connection.
+// Whatever remains unknown, e.g. a port hidden by NAT, is learned from the first datagram.
+func newUdpSourceFilter(req *Request) *udpSourceFilter {
+	f := &udpSourceFilter{}
+	if req.DestAddr != nil {
+		if len(req.DestAddr.IP) != 0 && !req.DestAddr.IP.IsUnspecified() {
+			f.ip = req.DestAddr.IP
+		}
+		f.port = req.DestAddr.Port
+	}
+	if f.ip == nil && req.RemoteAddr != nil && len(req.RemoteAddr.IP) != 0 {
+		f.ip = req.RemoteAddr.IP
 	}
+	return f
+}
+
+// accept reports whether a datagram from addr belongs to the association.
+// Unknown parts of the client address are learned from the first datagram.
+func (f *udpSourceFilter) accept(addr *net.UDPAddr) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ip != nil && !f.ip.Equal(addr.IP) {
+		return false
+	}
+	if f.port != 0 && f.port != addr.Port {
+		return false
+	}
+	f.ip = addr.IP
+	f.port = addr.Port
+	return true
+}
+
+// addr returns the client address, or nil if it is not completely known yet.
+func (f *udpSourceFilter) addr() *net.UDPAddr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ip == nil || f.port == 0 {
+		return nil
+	}
+	return &net.UDPAddr{IP: f.ip, Port: f.port}
 }
 
 // NewUdpAssociate creates a new UdpAssociate instance.
 func NewUdpAssociate() *UdpAssociate {
 	return &UdpAssociate{
-		m: make(map[string]*UdpPeer),
+		m:    make(map[string]*UdpPeer),
+		done: make(chan struct{}),
 	}
 }
 
 // doAssociate handles the UDP association request.
+// Datagrams are only accepted from the client of the association, see udpSourceFilter.
+// The association ends when the control connection is closed, when the session ends,
+// or when no datagram was relayed for Config.UDPAssociationIdleTimeout.
+//
+// The goroutine calling doAssociate reads the datagrams of the client. Every other goroutine,
+// e.g. the readers of the destinations, is owned by the UdpAssociate and has exited when doAssociate returns,
+// except the reader of the control connection, which exits once the caller closes the connection.
 func doAssociate(ctx context.Context, s *Server, conn conn, req *Request) error {
-	// FIXME: TCP and UDP connections must be associated, and UDP connections should be released when the TCP connection is closed.
-	// When the client requests UDP forwarding, DST.ADDR and DST.PORT may be local network addresses (after NAT), 0, or multiple connections may connect to the same target address.
-	// This can make it impossible for the server to uniquely match them. The server should bind a new port for each:
-	//   - If DST.ADDR or DST.PORT is zero.
-	//   - If DST.ADDR is a local network address, the server should bind a new port.
-	//   - If DST.ADDR is a public address and the target address has not been connected before, the server should reuse the port; otherwise, bind a new port.
-	udpServer := newUdpServer()
-	// Bind a random port
-	err := udpServer.Listen("udp", "0.0.0.0:0")
-	if err != nil {
-		return fmt.Errorf("doAssociate Failed to bind UDP server: %v", err)
+	// Only accept datagrams from the client of the association
+	source := newUdpSourceFilter(req)
+	var udpServer *UdpServer
+	var err error
+	if len(s.config.UDPSharedAddrs) > 0 {
+		// Share a port with the other associations
+		udpServer, err = s.sharedUDP.acquire(s, source)
+	} else {
+		udpServer = newUdpServer()
+		udpServer.ls, err = s.listenUDP(conn)
 	}
-	_, port, err := net.SplitHostPort(udpServer.LocalAddr().String())
 	if err != nil {
-		return fmt.Errorf("doAssociate Failed to SplitHostPort: %v", err)
+		sendReply(conn, serverFailure, nil)
+		return fmt.Errorf("doAssociate Failed to bind UDP server: %v", err)
 	}
-	bindPort, _ := strconv.Atoi(port)
 	defer udpServer.Close()
 
 	// Create a memory allocator
@@ -84,23 +394,120 @@ func doAssociate(ctx context.Context, s *Server, conn conn, req *Request) error
 	} else {
 		memCreater = new(Mem)
 	}
+	// Create a structure to cache new connections
+	peers := NewUdpAssociate()
+	peers.max = s.config.UDPMaxPeersPerAssociation
+	peers.table = &s.udpPeers
+	peers.tableMax = s.config.UDPMaxPeers
+	peers.touch()
+	defer func() {
+		peers.CloseAll()
+		peers.wait()
+	}()
+
 	go func() {
-		// Keep the SOCKS5 connection request
-		io.Copy(io.Discard, conn.(*net.TCPConn))
+		// Keep the SOCKS5 connection request, the client must not send anything else,
+		// and stop relaying once it is closed
+		io.Copy(io.Discard, req.bufConn)
+		udpServer.Close()
 	}()
+	if idle := s.config.UDPAssociationIdleTimeout; idle > 0 {
+		watchUdpAssociation(idle, peers, func() {
+			s.config.Logger.Printf("[INFO] socks: UDP association of %v idle for %v", req.RemoteAddr, idle)
+			udpServer.Close()
+		})
+	}
+	if req.session != nil {
+		// Stop relaying when the session is closed, e.g. because it was revoked
+		peers.spawn(func() {
+			select {
+			case <-req.session.Done():
+				udpServer.Close()
+			case <-peers.Done():
+			}
+		})
+	}
 
 	// Send success response
-	bindAddr := AddrSpec{IP: s.config.BindIP, Port: bindPort}
-	if err := sendReply(conn, successReply, &bindAddr); err != nil {
+	bindAddr := s.advertisedAddr(conn, udpServer.LocalAddr())
+	if err := sendReply(conn, successReply, bindAddr); err != nil {
 		return fmt.Errorf("doAssociate Failed to send reply: %v", err)
 	}
-	return readFromSrc(ctx, s, req, udpServer, memCreater)
+	return readFromSrc(ctx, s, req, source, peers, udpServer, memCreater)
+}
+
+// watchUdpAssociation calls expired once no datagram was relayed by the association for idle.
+// The watchdog stops when the association is closed.
+func watchUdpAssociation(idle time.Duration, peers *UdpAssociate, expired func()) {
+	peers.spawn(func() {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				remaining := idle - time.Since(peers.lastUsed())
+				if remaining <= 0 {
+					expired()
+					return
+				}
+				timer.Reset(remaining)
+			case <-peers.Done():
+				return
+			}
+		}
+	})
+}
+
+// sweepUdpPeers periodically closes the peers of an association that have been idle
+// for longer than Config.UDPPeerIdleTimeout. The sweeper stops when the association is closed.
+func sweepUdpPeers(s *Server, peers *UdpAssociate) {
+	idle := s.config.UDPPeerIdleTimeout
+	if idle == 0 {
+		idle = defaultUDPPeerIdleTimeout
+	}
+	if idle < 0 {
+		return
+	}
+	peers.spawn(func() {
+		interval := idle / 2
+		if interval <= 0 {
+			interval = idle
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := peers.expire(idle); n > 0 {
+					s.stats.udpPeersExpired.Add(uint64(n))
+				}
+			case <-peers.Done():
+				return
+			}
+		}
+	})
 }
 
 // readFromSrc processes data from the client.
-func readFromSrc(ctx context.Context, s *Server, req *Request, udpServer *UdpServer, memCreater MemAllocation) error {
-	// Create a structure to cache new connections
-	peers := NewUdpAssociate()
+func readFromSrc(ctx context.Context, s *Server, req *Request, source *udpSourceFilter, peers *UdpAssociate,
+	udpServer *UdpServer, memCreater MemAllocation) error {
+	// Close peers that have been idle for too long
+	sweepUdpPeers(s, peers)
+	// Reassemble fragmented datagrams
+	reasm := newReassembler(s.config.UDPReassemblyTimeout, s.config.UDPReassemblyLimit)
+	// Share one outbound socket between all destinations in full-cone mode
+	var relay *fullConeRelay
+	if s.config.UDPFullCone {
+		var err error
+		if relay, err = listenFullCone(s, req, source, peers, udpServer); err != nil {
+			return fmt.Errorf("readFromSrc Failed to bind outbound UDP socket: %v", err)
+		}
+		peers.spawn(func() {
+			<-peers.Done()
+			relay.Close()
+		})
+		peers.spawn(func() { relay.serve(ctx, memCreater) })
+	}
 	// UDP packets cannot exceed 65536 bytes
 	bs := make([]byte, 65536)
 	var n int
@@ -113,28 +520,59 @@ func readFromSrc(ctx context.Context, s *Server, req *Request, udpServer *UdpSer
 		if err != nil {
 			break
 		}
-		// Parse the data
-		datagram, err = NewDatagramFromByte(ctx, memCreater, bs[:n])
-		if err != nil {
-			break
+		if !source.accept(from) {
+			s.stats.udpSpoofedDropped.Add(1)
+			continue
+		}
+		req.session.addIn(n)
+		peers.touch()
+		// Parse the data, a malformed datagram is dropped without ending the association
+		var parseErr error
+		datagram, parseErr = NewDatagramFromByte(ctx, memCreater, bs[:n])
+		if parseErr != nil {
+			s.stats.udpMalformedDropped.Add(1)
+			s.config.Logger.Printf("[WARN] socks: Dropped malformed datagram from %v: %v", from, parseErr)
+			continue
+		}
+		if datagram.Frag == 0 {
+			// A standalone datagram abandons any pending sequence
+			reasm.reset()
+		} else {
+			payload, done := reasm.add(datagram.Frag, datagram.Address(), datagram.Data)
+			fragment := datagram
+			datagram = nil
+			if done {
+				datagram = NewDatagram(ctx, memCreater, fragment.ATyp, fragment.host(), fragment.DstPort, payload)
+			}
+			fragment.free(ctx)
+			if datagram == nil {
+				continue
+			}
 		}
 		// Process the data
-		handleDatagram(ctx, s, req, peers, udpServer, memCreater, from, datagram)
+		if err := handleDatagram(ctx, s, req, peers, relay, udpServer, memCreater, from, datagram); err != nil {
+			s.config.Logger.Printf("[WARN] socks: Dropped datagram: %v", err)
+		}
 		// Release memory
 		datagram.free(ctx)
 		datagram = nil
 	}
-	fmt.Printf("readFromSrc fail: %v\n", err)
 	// Release all requests when the SOCKS5 connection ends
 	peers.CloseAll()
 	if datagram != nil {
 		datagram.free(ctx)
 	}
+	if errors.Is(err, net.ErrClosed) {
+		// The association ended, e.g. because the control connection was closed
+		return nil
+	}
 	return err
 }
 
 // handleDatagram processes data from the client.
-func handleDatagram(ctx context.Context, s *Server, req *Request, peers *UdpAssociate,
+// In full-cone mode, relay is the outbound socket of the association, otherwise it is nil
+// and each destination is dialed.
+func handleDatagram(ctx context.Context, s *Server, req *Request, peers *UdpAssociate, relay *fullConeRelay,
 	udpServer *UdpServer, memCreater MemAllocation,
 	from *net.UDPAddr, datagram *Datagram) error {
 	// Calculate the key
@@ -142,48 +580,83 @@ func handleDatagram(ctx context.Context, s *Server, req *Request, peers *UdpAsso
 
 	udpPeer, ok := peers.Get(key)
 	if !ok {
-		// New connection
-		// Attempt to connect
-		dial := s.config.Dial
-		if dial == nil {
-			dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-				return net.Dial(net_, addr)
-			}
+		// New destination, check it like a request of its own
+		peerReq := &Request{
+			Version:     socks5Version,
+			Command:     AssociateCommand,
+			AuthContext: req.AuthContext,
+			RemoteAddr:  req.RemoteAddr,
+			DestAddr:    datagram.addrSpec(),
+			session:     req.session,
+			Datagram:    true,
 		}
-		dst, err := dial(ctx, "udp", datagram.Address())
+		ctx, err := s.resolveRequest(ctx, peerReq)
 		if err != nil {
-			return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+			return err
+		}
+		if ip := peerReq.realDestAddr.IP; ip != nil && ip.IsUnspecified() {
+			// The unspecified address reaches the services of the proxy host itself
+			s.stats.udpDeniedDropped.Add(1)
+			return fmt.Errorf("datagram to unspecified address %v dropped", peerReq.DestAddr)
+		}
+		ctx, ok = s.allow(ctx, peerReq)
+		if !ok {
+			s.stats.udpDeniedDropped.Add(1)
+			return fmt.Errorf("datagram to %v blocked by rules", peerReq.DestAddr)
 		}
-		s.config.Logger.Printf("handleDatagram dial %v success.\n", datagram.Address())
 
 		// Create a new connection
 		udpPeer = new(UdpPeer)
-		udpPeer.updateTime = time.Now().Unix()
 		udpPeer.udpServer = udpServer
 		udpPeer.from = *from
-		udpPeer.req = req
-		udpPeer.dst = dst
+		udpPeer.req = peerReq
 		udpPeer.atyp = datagram.ATyp
 		// Note: Do not directly reference datagram's reference type data
-		udpPeer.dstAddr = make([]byte, len(datagram.DstAddr))
-		copy(udpPeer.dstAddr, datagram.DstAddr)
+		dstAddr := datagram.host()
+		udpPeer.dstAddr = make([]byte, len(dstAddr))
+		copy(udpPeer.dstAddr, dstAddr)
 		// Note: Do not directly reference datagram's reference type data
 		udpPeer.dstPort = make([]byte, len(datagram.DstPort))
 		copy(udpPeer.dstPort, datagram.DstPort)
 
-		peers.Set(key, udpPeer)
-		go readFromDst(ctx, s, udpPeer, memCreater)
+		if relay != nil {
+			dstAddr, err := net.ResolveUDPAddr("udp", peerReq.realDestAddr.Address())
+			if err != nil {
+				return fmt.Errorf("Connect to %v failed: %v", peerReq.DestAddr, err)
+			}
+			udpPeer.dst = relay.conn(udpPeer, dstAddr)
+		} else {
+			// Attempt to connect
+			dial := s.config.Dial
+			if dial == nil {
+				dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
+					return net.Dial(net_, addr)
+				}
+			}
+			dst, err := dial(ctx, "udp", peerReq.realDestAddr.Address())
+			if err != nil {
+				return fmt.Errorf("Connect to %v failed: %v", peerReq.DestAddr, err)
+			}
+			s.config.Logger.Printf("handleDatagram dial %v success.\n", peerReq.realDestAddr.Address())
+			udpPeer.dst = dst
+		}
+
+		if evicted := peers.add(key, udpPeer); evicted > 0 {
+			s.stats.udpPeersEvicted.Add(uint64(evicted))
+		}
+		if relay == nil {
+			peers.spawn(func() { readFromDst(ctx, s, udpPeer, memCreater) })
+		}
 	}
 	// Write data to the target
 	_, err := udpPeer.dst.Write(datagram.Data)
 	if err != nil {
 		// This should generally not happen
 		fmt.Printf("udpPeer.dst.Write fail: %v\n", err)
-		udpPeer.dst.Close()
-		peers.Del(key)
+		peers.remove(udpPeer)
 	} else {
 		// Update the timestamp
-		udpPeer.updateTime = time.Now().Unix()
+		udpPeer.touch()
 	}
 	return nil
 }
@@ -191,36 +664,62 @@ func handleDatagram(ctx context.Context, s *Server, req *Request, peers *UdpAsso
 // readFromDst processes data from the target address.
 func readFromDst(ctx context.Context, s *Server, udpPeer *UdpPeer, memCreater MemAllocation) error {
 	bs := make([]byte, 65536)
+	out := make([]byte, 65536)
 	var n int
 	var err error
-	var datagram *Datagram
 	for {
 		n, err = udpPeer.dst.Read(bs)
 		if err != nil {
 			break
 		}
-		datagram = NewDatagram(ctx, memCreater, udpPeer.atyp, udpPeer.dstAddr, udpPeer.dstPort, bs[:n])
-		if datagram == nil {
-			err = fmt.Errorf("readFromDst NewDatagram fail")
-			break
-		}
-		n = datagram.toBytes(ctx, bs)
-		if n <= 0 {
-			err = fmt.Errorf("readFromDst NewDatagram packet more than 65536")
-			break
-		}
-		_, err = udpPeer.udpServer.WriteToUDP(bs[:n], &udpPeer.from)
-		if err != nil {
+		if err = relayToSrc(ctx, s, udpPeer, memCreater, bs[:n], out); err != nil {
 			break
 		}
 		// Update the timestamp
-		udpPeer.updateTime = time.Now().Unix()
-		// Release memory
-		datagram.free(ctx)
-		datagram = nil
+		udpPeer.touch()
 	}
-	if datagram != nil {
-		datagram.free(ctx)
+	// The peer is gone, e.g. because it expired or was evicted
+	if udpPeer.assoc != nil {
+		udpPeer.assoc.remove(udpPeer)
 	}
 	return err
 }
+
+// relayToSrc sends a datagram to the client, split into fragments if it is larger than
+// Config.UDPFragmentSize. Datagrams that cannot be fragmented are dropped.
+func relayToSrc(ctx context.Context, s *Server, udpPeer *UdpPeer, memCreater MemAllocation, data, buf []byte) error {
+	parts, frags, err := fragmentPayload(data, s.config.UDPFragmentSize)
+	if err != nil {
+		s.config.Logger.Printf("[WARN] socks: Dropped datagram from %v: %v", udpPeer.req.DestAddr, err)
+		return nil
+	}
+	for i, part := range parts {
+		if err := writeToSrc(ctx, udpPeer, memCreater, frags[i], part, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeToSrc sends a datagram or a fragment of it with the given FRAG field to the client.
+func writeToSrc(ctx context.Context, udpPeer *UdpPeer, memCreater MemAllocation, frag byte, data, buf []byte) error {
+	datagram := NewDatagram(ctx, memCreater, udpPeer.atyp, udpPeer.dstAddr, udpPeer.dstPort, data)
+	if datagram == nil {
+		return fmt.Errorf("readFromDst NewDatagram fail")
+	}
+	// Release memory
+	defer datagram.free(ctx)
+	datagram.Frag = frag
+	n := datagram.toBytes(ctx, buf)
+	if n <= 0 {
+		return fmt.Errorf("readFromDst NewDatagram packet more than 65536")
+	}
+	if _, err := udpPeer.udpServer.WriteToUDP(buf[:n], &udpPeer.from); err != nil {
+		return err
+	}
+	udpPeer.req.session.addOut(n)
+	if udpPeer.assoc != nil {
+		udpPeer.assoc.touch()
+	}
+	return nil
+}
@@ -2,12 +2,18 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -107,3 +113,745 @@ func TestSOCKS5_Associate(t *testing.T) {
 		// No errors, continue
 	}
 }
+
+// startUDPEcho starts a UDP server echoing every datagram with the given prefix.
+func startUDPEcho(t *testing.T, prefix string) *net.UDPConn {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		var buf [2048]byte
+		for {
+			n, from, err := l.ReadFromUDP(buf[:])
+			if err != nil {
+				return
+			}
+			l.WriteToUDP(append([]byte(prefix), buf[:n]...), from)
+		}
+	}()
+	return l
+}
+
+// startServer starts a server with conf listening on addr and returns it with its address.
+// The listener is closed when the test ends.
+func startServer(t *testing.T, network, addr string, conf *Config) (*Server, string) {
+	t.Helper()
+	if conf.Logger == nil {
+		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("cannot listen on %v: %v", addr, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serv.Serve(l)
+	return serv, l.Addr().String()
+}
+
+// associate performs a UDP ASSOCIATE and returns the control connection and the relay address.
+func associate(t *testing.T, server, src string) (net.Conn, *net.UDPAddr) {
+	ctrl, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &Dialer{}
+	if err := d.connectAuth(ctrl); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr, err := d.connectCommand(ctrl, AssociateCommand, src)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	relay, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return ctrl, relay
+}
+
+// udpExchange sends payload to dst through the relay and waits for a reply.
+func udpExchange(conn *net.UDPConn, relay *net.UDPAddr, dst string, payload []byte, timeout time.Duration) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{0, 0, 0})
+	if err := writeAddrWithStr(buf, dst); err != nil {
+		return nil, err
+	}
+	buf.Write(payload)
+	if _, err := conn.WriteToUDP(buf.Bytes(), relay); err != nil {
+		return nil, err
+	}
+	var resp [2048]byte
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(resp[:])
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDatagramFromBytes(resp[:n])
+	if err != nil {
+		return nil, err
+	}
+	return d.Data, nil
+}
+
+func TestSOCKS5_Associate_SourceFilter(t *testing.T) {
+	echo := startUDPEcho(t, "pong-")
+	defer echo.Close()
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{})
+
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+	other, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer other.Close()
+
+	// The first datagram pins the client port
+	resp, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second)
+	if err != nil || string(resp) != "pong-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+
+	// Datagrams from another port are dropped
+	if _, err := udpExchange(other, relay, echo.LocalAddr().String(), []byte("ping"), 100*time.Millisecond); err == nil {
+		t.Fatalf("expect spoofed datagram to be dropped")
+	}
+	if n := serv.Stats().UDPSpoofedDropped; n != 1 {
+		t.Fatalf("expect 1 dropped datagram, got %v", n)
+	}
+
+	// The client keeps working
+	if resp, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second); err != nil || string(resp) != "pong-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+}
+
+func TestSOCKS5_Associate_DeclaredSource(t *testing.T) {
+	echo := startUDPEcho(t, "pong-")
+	defer echo.Close()
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{})
+
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+	other, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer other.Close()
+
+	// The client declares its source address in the request
+	ctrl, relay := associate(t, addr, client.LocalAddr().String())
+	defer ctrl.Close()
+
+	if _, err := udpExchange(other, relay, echo.LocalAddr().String(), []byte("ping"), 100*time.Millisecond); err == nil {
+		t.Fatalf("expect datagram from undeclared port to be dropped")
+	}
+	if resp, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second); err != nil || string(resp) != "pong-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+	if n := serv.Stats().UDPSpoofedDropped; n != 1 {
+		t.Fatalf("expect 1 dropped datagram, got %v", n)
+	}
+}
+
+type staticResolver map[string]net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ip, ok := r[name]; ok {
+		return ctx, ip, nil
+	}
+	return ctx, nil, fmt.Errorf("unknown host %v", name)
+}
+
+func TestSOCKS5_Associate_DatagramRules(t *testing.T) {
+	allowed := startUDPEcho(t, "allowed-")
+	defer allowed.Close()
+	denied := startUDPEcho(t, "denied-")
+	defer denied.Close()
+
+	allowedPort := allowed.LocalAddr().(*net.UDPAddr).Port
+	rules, err := PermitDestinations("echo.test:" + strconv.Itoa(allowedPort))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{
+		Rules:    rules,
+		Resolver: staticResolver{"echo.test": net.ParseIP("127.0.0.1")},
+	})
+
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	// The destination name is resolved by the server's resolver and checked by its rules
+	resp, err := udpExchange(client, relay, net.JoinHostPort("echo.test", strconv.Itoa(allowedPort)), []byte("ping"), time.Second)
+	if err != nil || string(resp) != "allowed-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+
+	if _, err := udpExchange(client, relay, denied.LocalAddr().String(), []byte("ping"), 100*time.Millisecond); err == nil {
+		t.Fatalf("expect denied datagram to be dropped")
+	}
+	if n := serv.Stats().UDPDeniedDropped; n != 1 {
+		t.Fatalf("expect 1 denied datagram, got %v", n)
+	}
+}
+
+func TestSOCKS5_Associate_UnspecifiedDestination(t *testing.T) {
+	echo := startUDPEcho(t, "echo-")
+	defer echo.Close()
+	port := strconv.Itoa(echo.LocalAddr().(*net.UDPAddr).Port)
+	rules, err := PermitDestinations("127.0.0.1:" + port)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{Rules: rules})
+
+	// The ASSOCIATE request declares the source of the client, which is not a destination
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	ctrl, relay := associate(t, addr, client.LocalAddr().String())
+	defer ctrl.Close()
+
+	resp, err := udpExchange(client, relay, "127.0.0.1:"+port, []byte("ping"), time.Second)
+	if err != nil || string(resp) != "echo-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+
+	// The unspecified address would reach the proxy host itself
+	for _, dst := range []string{"0.0.0.0:" + port, "[::]:" + port} {
+		if _, err := udpExchange(client, relay, dst, []byte("ping"), 100*time.Millisecond); err == nil {
+			t.Fatalf("expect datagram to %v to be dropped", dst)
+		}
+	}
+	if n := serv.Stats().UDPDeniedDropped; n != 2 {
+		t.Fatalf("expect 2 denied datagrams, got %v", n)
+	}
+}
+
+func TestSOCKS5_Associate_PeerIdleTimeout(t *testing.T) {
+	echo := startUDPEcho(t, "echo-")
+	defer echo.Close()
+
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{UDPPeerIdleTimeout: 100 * time.Millisecond})
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	if _, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := serv.Stats().UDPPeers; n != 1 {
+		t.Fatalf("expect 1 peer, got %v", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for serv.Stats().UDPPeers != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	stats := serv.Stats()
+	if stats.UDPPeers != 0 || stats.UDPPeersExpired != 1 {
+		t.Fatalf("expect idle peer to expire: %+v", stats)
+	}
+
+	// The destination is dialed again
+	resp, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second)
+	if err != nil || string(resp) != "echo-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+}
+
+func TestSOCKS5_Associate_MaxPeers(t *testing.T) {
+	var echos []*net.UDPConn
+	for i := 0; i < 3; i++ {
+		echo := startUDPEcho(t, "echo-")
+		defer echo.Close()
+		echos = append(echos, echo)
+	}
+
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{UDPMaxPeersPerAssociation: 2, UDPMaxPeers: 3})
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	for _, echo := range echos {
+		if _, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	stats := serv.Stats()
+	if stats.UDPPeers != 2 || stats.UDPPeersEvicted != 1 {
+		t.Fatalf("expect least recently used peer of the association to be evicted: %+v", stats)
+	}
+
+	// A second association shares the limit of the server
+	ctrl2, relay2 := associate(t, addr, "0.0.0.0:0")
+	defer ctrl2.Close()
+	client2, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client2.Close()
+	for _, echo := range echos[:2] {
+		if _, err := udpExchange(client2, relay2, echo.LocalAddr().String(), []byte("ping"), time.Second); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	stats = serv.Stats()
+	if stats.UDPPeers != 3 || stats.UDPPeersEvicted != 2 {
+		t.Fatalf("expect least recently used peer of the server to be evicted: %+v", stats)
+	}
+}
+
+func TestSOCKS5_Associate_ControlClosed(t *testing.T) {
+	echo := startUDPEcho(t, "echo-")
+	defer echo.Close()
+
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{})
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	if _, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Closing the control connection ends the association
+	ctrl.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for (serv.Stats().UDPPeers != 0 || len(serv.Sessions()) != 0) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := serv.Stats().UDPPeers; n != 0 {
+		t.Fatalf("expect peers to be closed, got %v", n)
+	}
+	if n := len(serv.Sessions()); n != 0 {
+		t.Fatalf("expect session to end, got %v", n)
+	}
+	if _, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), 100*time.Millisecond); err == nil {
+		t.Fatalf("expect relay to be closed")
+	}
+}
+
+func TestSOCKS5_Associate_IdleTimeout(t *testing.T) {
+	_, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{UDPAssociationIdleTimeout: 100 * time.Millisecond})
+	ctrl, _ := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+
+	// The server closes the control connection of the idle association
+	ctrl.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [1]byte
+	if _, err := ctrl.Read(buf[:]); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+}
+
+func TestSOCKS5_Associate_UnixControl(t *testing.T) {
+	echo := startUDPEcho(t, "echo-")
+	defer echo.Close()
+
+	serv, err := New(&Config{BindIP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	ctrl, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := &Dialer{}
+	if err := d.connectAuth(ctrl); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bound, err := d.connectCommand(ctrl, AssociateCommand, "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	relay, _ := net.ResolveUDPAddr("udp", bound.String())
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	resp, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second)
+	if err != nil || string(resp) != "echo-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+
+	ctrl.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for serv.Stats().UDPPeers != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := serv.Stats().UDPPeers; n != 0 {
+		t.Fatalf("expect peers to be closed, got %v", n)
+	}
+}
+
+func TestSOCKS5_Associate_SharedPort(t *testing.T) {
+	echo := startUDPEcho(t, "echo-")
+	defer echo.Close()
+
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{UDPSharedAddrs: []string{"127.0.0.1:0"}})
+	ctrl1, relay1 := associate(t, addr, "0.0.0.0:0")
+	defer ctrl1.Close()
+	ctrl2, relay2 := associate(t, addr, "0.0.0.0:0")
+	defer ctrl2.Close()
+	if relay1.String() != relay2.String() {
+		t.Fatalf("expect associations to share a port: %v %v", relay1, relay2)
+	}
+
+	var clients []*net.UDPConn
+	for i := 0; i < 3; i++ {
+		client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	// Each client is learned by the oldest association that has not learned its client yet
+	for _, client := range clients[:2] {
+		resp, err := udpExchange(client, relay1, echo.LocalAddr().String(), []byte("ping"), time.Second)
+		if err != nil || string(resp) != "echo-ping" {
+			t.Fatalf("bad response %q: %v", resp, err)
+		}
+	}
+	if n := serv.Stats().UDPPeers; n != 2 {
+		t.Fatalf("expect a peer per association, got %v", n)
+	}
+
+	// A third client has no association
+	if _, err := udpExchange(clients[2], relay1, echo.LocalAddr().String(), []byte("ping"), 100*time.Millisecond); err == nil {
+		t.Fatalf("expect datagram without association to be dropped")
+	}
+	if n := serv.Stats().UDPSpoofedDropped; n != 1 {
+		t.Fatalf("expect 1 dropped datagram, got %v", n)
+	}
+
+	// A new association takes over the port of the first client once its association ended
+	ctrl1.Close()
+	time.Sleep(100 * time.Millisecond)
+	ctrl3, _ := associate(t, addr, "0.0.0.0:0")
+	defer ctrl3.Close()
+	resp, err := udpExchange(clients[0], relay1, echo.LocalAddr().String(), []byte("ping"), time.Second)
+	if err != nil || string(resp) != "echo-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+}
+
+func TestSOCKS5_Associate_SharedPortClose(t *testing.T) {
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{UDPSharedAddrs: []string{"127.0.0.1:0"}})
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+
+	// Closing the server releases the shared port
+	if err := serv.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ls, err := net.ListenUDP("udp", relay)
+	if err != nil {
+		t.Fatalf("expect shared port to be released: %v", err)
+	}
+	ls.Close()
+}
+
+func TestSOCKS5_Associate_FullCone(t *testing.T) {
+	// The reflector tells the client the address it received the datagram from
+	reflector, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer reflector.Close()
+	go func() {
+		var buf [2048]byte
+		for {
+			_, from, err := reflector.ReadFromUDP(buf[:])
+			if err != nil {
+				return
+			}
+			reflector.WriteToUDP([]byte(from.String()), from)
+		}
+	}()
+	third, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer third.Close()
+	denied, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer denied.Close()
+
+	rules, err := PermitDestinations(reflector.LocalAddr().String(), third.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{UDPFullCone: true, Rules: rules})
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	resp, err := udpExchange(client, relay, reflector.LocalAddr().String(), []byte("ping"), time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	outbound, err := net.ResolveUDPAddr("udp", string(resp))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A permitted remote reaches the client through the outbound address, with its own source address
+	third.WriteToUDP([]byte("hello"), outbound)
+	var buf [2048]byte
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf[:])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d, err := NewDatagramFromBytes(buf[:n])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(d.Data) != "hello" || d.Address() != third.LocalAddr().String() {
+		t.Fatalf("bad datagram %q from %v", d.Data, d.Address())
+	}
+
+	// Other remotes are subject to the rules
+	denied.WriteToUDP([]byte("hello"), outbound)
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(buf[:]); err == nil {
+		t.Fatalf("expect datagram from denied remote to be dropped")
+	}
+	if n := serv.Stats().UDPDeniedDropped; n != 1 {
+		t.Fatalf("expect 1 denied datagram, got %v", n)
+	}
+}
+
+func TestSOCKS5_Associate_Malformed(t *testing.T) {
+	echo := startUDPEcho(t, "echo-")
+	defer echo.Close()
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{Logger: log.New(io.Discard, "", 0)})
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	// A malformed datagram is dropped and the association keeps relaying
+	client.WriteToUDP([]byte{0, 0, 0, 9}, relay)
+	resp, err := udpExchange(client, relay, echo.LocalAddr().String(), []byte("ping"), time.Second)
+	if err != nil || string(resp) != "echo-ping" {
+		t.Fatalf("bad response %q: %v", resp, err)
+	}
+	if n := serv.Stats().UDPMalformedDropped; n != 1 {
+		t.Fatalf("expect 1 malformed datagram, got %v", n)
+	}
+}
+
+func TestSOCKS5_Associate_FullConeListenPorts(t *testing.T) {
+	reflector, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer reflector.Close()
+	go func() {
+		var buf [2048]byte
+		for {
+			_, from, err := reflector.ReadFromUDP(buf[:])
+			if err != nil {
+				return
+			}
+			reflector.WriteToUDP([]byte(from.String()), from)
+		}
+	}()
+
+	// Find a free port
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+
+	// The relay takes the only port of the range, the outbound socket does not need one
+	_, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{
+		UDPFullCone: true,
+		ListenIP:    net.ParseIP("127.0.0.1"),
+		ListenPorts: PortRange{First: port, Last: port},
+	})
+	ctrl, relay := associate(t, addr, "0.0.0.0:0")
+	defer ctrl.Close()
+	if relay.Port != port {
+		t.Fatalf("expect relay on port %v, got %v", port, relay)
+	}
+	client, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer client.Close()
+
+	resp, err := udpExchange(client, relay, reflector.LocalAddr().String(), []byte("ping"), time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	outbound, err := net.ResolveUDPAddr("udp", string(resp))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if outbound.Port == port {
+		t.Fatalf("expect outbound socket not to use the listen port, got %v", outbound)
+	}
+}
+
+func TestSOCKS5_Associate_Stress(t *testing.T) {
+	var echos []*net.UDPConn
+	for i := 0; i < 4; i++ {
+		echo := startUDPEcho(t, "echo-")
+		defer echo.Close()
+		echos = append(echos, echo)
+	}
+	before := runtime.NumGoroutine()
+
+	// Small limits and timeouts let eviction and expiry race with the relaying
+	serv, addr := startServer(t, "tcp", "127.0.0.1:0", &Config{
+		UDPMaxPeersPerAssociation: 2,
+		UDPMaxPeers:               6,
+		UDPPeerIdleTimeout:        20 * time.Millisecond,
+		Logger:                    log.New(io.Discard, "", 0),
+	})
+
+	// Set up the associations on the test goroutine, associate may call t.Fatalf
+	type clientAssociation struct {
+		ctrl   net.Conn
+		relay  *net.UDPAddr
+		client *net.UDPConn
+	}
+	clients := make([]clientAssociation, 8)
+	for i := range clients {
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		ctrl, relay := associate(t, addr, "0.0.0.0:0")
+		clients[i] = clientAssociation{ctrl: ctrl, relay: relay, client: client}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctrl, relay, client := c.ctrl, c.relay, c.client
+			defer client.Close()
+			go func() {
+				var buf [2048]byte
+				for {
+					if _, err := client.Read(buf[:]); err != nil {
+						return
+					}
+				}
+			}()
+			for j := 0; j < 200; j++ {
+				buf := bytes.NewBuffer([]byte{0, 0, 0})
+				writeAddrWithStr(buf, echos[j%len(echos)].LocalAddr().String())
+				buf.WriteString("ping")
+				client.WriteToUDP(buf.Bytes(), relay)
+				if j%50 == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			ctrl.Close()
+		}()
+	}
+	wg.Wait()
+
+	// Every association shuts down with its peers and goroutines
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if serv.Stats().UDPPeers == 0 && len(serv.Sessions()) == 0 && runtime.NumGoroutine() <= before+1 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := serv.Stats().UDPPeers; n != 0 {
+		t.Fatalf("expect peers to be closed, got %v", n)
+	}
+	if n := len(serv.Sessions()); n != 0 {
+		t.Fatalf("expect sessions to end, got %v", n)
+	}
+	// The server's accept loop remains
+	if n := runtime.NumGoroutine(); n > before+1 {
+		t.Fatalf("expect goroutines to exit, %v before and %v after", before, n)
+	}
+}
+
+func TestDialer_ListenPacket(t *testing.T) {
+	first := startUDPEcho(t, "first-")
+	defer first.Close()
+	second := startUDPEcho(t, "second-")
+	defer second.Close()
+	serv, server := startServer(t, "tcp", "127.0.0.1:0", &Config{
+		Resolver: staticResolver{"echo.test": net.ParseIP("127.0.0.1")},
+	})
+
+	dial := &Dialer{ProxyNetwork: "tcp", ProxyAddress: server}
+	pc, err := dial.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer pc.Close()
+
+	secondAddr := second.LocalAddr().(*net.UDPAddr)
+	dsts := []struct {
+		addr   net.Addr
+		expect string
+	}{
+		{first.LocalAddr(), "first-ping"},
+		{&address{Name: "echo.test", Port: secondAddr.Port}, "second-ping"},
+	}
+	for _, dst := range dsts {
+		if _, err := pc.WriteTo([]byte("ping"), dst.addr); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		var buf [64]byte
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(buf[:n]) != dst.expect {
+			t.Fatalf("expect %q, got %q", dst.expect, buf[:n])
+		}
+		if from.String() != dst.addr.String() {
+			t.Fatalf("expect reply from %v, got %v", dst.addr, from)
+		}
+	}
+
+	// Dropping the control connection closes the association
+	for _, sess := range serv.Sessions() {
+		sess.Close("test")
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [64]byte
+	if _, _, err := pc.ReadFrom(buf[:]); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect net.ErrClosed, got %v", err)
+	}
+}
+
+func TestPeerLRU(t *testing.T) {
+	var q peerLRU
+	peers := make([]*UdpPeer, 3)
+	for i := range peers {
+		peers[i] = &UdpPeer{key: strconv.Itoa(i)}
+		atomic.StoreInt64(&peers[i].updateTime, int64(i+1))
+		peers[i].assocElem = q.push(peers[i])
+	}
+
+	// Peer 0 was used after it was placed, so peer 1 is the least recently used
+	atomic.StoreInt64(&peers[0].updateTime, 10)
+	if v := q.evict(); v != peers[1] {
+		t.Fatalf("expect peer 1, got %v", v.key)
+	}
+	q.remove(peers[2].assocElem)
+	q.remove(peers[2].assocElem)
+	if v := q.evict(); v != peers[0] {
+		t.Fatalf("expect peer 0, got %v", v.key)
+	}
+	if v := q.evict(); v != nil {
+		t.Fatalf("expect empty list, got %v", v.key)
+	}
+}
@@ -1,8 +1,13 @@
 package socks5
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"time"
 )
 
 const (
@@ -26,11 +31,19 @@ const (
 )
 
 var (
+	// ErrCredentialsRejected is returned by a CredentialVerifier, possibly wrapped, when it rejects
+	// the credentials.
+	ErrCredentialsRejected = fmt.Errorf("user authentication failed")
+
 	// UserAuthFailed is an error returned when user authentication fails.
-	errUserAuthFailed = fmt.Errorf("user authentication failed")
+	errUserAuthFailed = ErrCredentialsRejected
 
 	// NoSupportedAuth is an error returned when no supported authentication mechanisms are available.
 	errNoSupportedAuth = fmt.Errorf("no supported authentication mechanism")
+
+	// errCredentialVerify is returned when the credential store failed to verify the credentials,
+	// rather than rejecting them.
+	errCredentialVerify = fmt.Errorf("failed to verify credentials")
 )
 
 // AuthContext encapsulates authentication state provided during negotiation.
@@ -42,6 +55,14 @@ type AuthContext struct {
 	// The keys depend on the used authentication method.
 	// For UserPassAuth, it contains the username.
 	Payload map[string]string
+
+	// Rules optionally restricts the requests of the session.
+	// It is evaluated in addition to the RuleSet of the server.
+	Rules RuleSet
+
+	// Expires is the time the session ends, e.g. because the credentials expire.
+	// The client connection is closed at this time. The zero value means no expiry.
+	Expires time.Time
 }
 
 // Authenticator is an interface for handling authentication.
@@ -55,6 +76,132 @@ type Authenticator interface {
 	GetCode() uint8
 }
 
+// ConnMetadata describes the client connection that is being authenticated.
+type ConnMetadata struct {
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+
+	// LocalAddr is the address of the listener the client connected to.
+	LocalAddr net.Addr
+
+	// TLS holds the state of the connection when the client connected over TLS.
+	// It is nil for plain connections.
+	TLS *tls.ConnectionState
+}
+
+// ConnAuthenticator is an Authenticator that is also given a context and the metadata of the
+// connection being authenticated. It allows authentication decisions based on the client address,
+// the listener or the TLS identity of the client.
+//
+// The Server calls AuthenticateConn instead of Authenticate when an Authenticator implements it,
+// so existing Authenticator implementations keep working unchanged.
+type ConnAuthenticator interface {
+	Authenticator
+
+	// AuthenticateConn performs the authentication process for the connection described by meta.
+	// meta is never nil when called by the Server.
+	// It returns an AuthContext if the authentication is successful, and an error if it fails.
+	AuthenticateConn(ctx context.Context, meta *ConnMetadata, reader io.Reader, writer io.Writer) (*AuthContext, error)
+}
+
+// isUnix reports whether the connection described by meta is a Unix domain socket connection.
+func (m *ConnMetadata) isUnix() bool {
+	return isUnixAddr(m.LocalAddr) || isUnixAddr(m.RemoteAddr)
+}
+
+// isUnixAddr reports whether addr is a Unix domain socket address.
+func isUnixAddr(addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	switch addr.Network() {
+	case "unix", "unixgram", "unixpacket":
+		return true
+	}
+	return false
+}
+
+// AuthPolicy is an interface used to select the authentication methods a client may use.
+// It lets the server, rather than the client, decide which method is used when several are acceptable.
+type AuthPolicy interface {
+	// Methods returns the authentication methods permitted for the connection described by meta,
+	// in the server's order of preference. The first method also offered by the client is used.
+	Methods(ctx context.Context, meta *ConnMetadata) []uint8
+}
+
+// AuthRule permits a list of authentication methods to clients from given source networks.
+type AuthRule struct {
+	// Networks are the source networks the rule applies to.
+	Networks []*net.IPNet
+
+	// Unix specifies whether the rule applies to clients connected over a Unix domain socket.
+	Unix bool
+
+	// Methods are the permitted authentication methods, in order of preference.
+	Methods []uint8
+}
+
+// match reports whether the rule applies to the connection described by meta.
+func (r *AuthRule) match(meta *ConnMetadata) bool {
+	if meta.isUnix() {
+		return r.Unix
+	}
+	ip := addrIP(meta.RemoteAddr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceAuthPolicy is an implementation of the AuthPolicy interface which selects the permitted
+// authentication methods by the source network of the client.
+//
+// For example, the following policy allows "auth-less" mode from loopback and Unix sockets only,
+// and requires a password from everywhere else:
+//
+//	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+//	policy := &SourceAuthPolicy{
+//		Rules:   []AuthRule{{Networks: []*net.IPNet{loopback}, Unix: true, Methods: []uint8{NoAuth, UserPassAuth}}},
+//		Default: []uint8{UserPassAuth},
+//	}
+type SourceAuthPolicy struct {
+	// Rules are evaluated in order, the first rule matching the client is used.
+	Rules []AuthRule
+
+	// Default are the methods permitted to clients not matched by any rule, in order of preference.
+	Default []uint8
+}
+
+// Methods returns the authentication methods of the first rule matching the client,
+// or the default methods if no rule matches.
+func (p *SourceAuthPolicy) Methods(ctx context.Context, meta *ConnMetadata) []uint8 {
+	for i := range p.Rules {
+		if p.Rules[i].match(meta) {
+			return p.Rules[i].Methods
+		}
+	}
+	return p.Default
+}
+
+// newConnMetadata collects the metadata of a client connection.
+// The TLS state is only available once the handshake has completed.
+func newConnMetadata(conn net.Conn) *ConnMetadata {
+	meta := &ConnMetadata{
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+	}
+	if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := tlsConn.ConnectionState()
+		meta.TLS = &state
+	}
+	return meta
+}
+
 // NoAuthAuthenticator is an implementation of the Authenticator interface for the "No Authentication" method.
 type NoAuthAuthenticator struct{}
 
@@ -66,6 +213,12 @@ func (a NoAuthAuthenticator) GetCode() uint8 {
 // Authenticate implements the Authenticator interface for the "No Authentication" method.
 // It always returns a successful AuthContext with the NoAuth method and an empty payload.
 func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return a.AuthenticateConn(context.Background(), nil, reader, writer)
+}
+
+// AuthenticateConn implements the ConnAuthenticator interface for the "No Authentication" method.
+// The connection metadata is not used.
+func (a NoAuthAuthenticator) AuthenticateConn(ctx context.Context, meta *ConnMetadata, reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	_, err := writer.Write([]byte{socks5Version, NoAuth})
 	return &AuthContext{Method: NoAuth, Payload: nil}, err
 }
@@ -84,6 +237,13 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 // Authenticate performs the user/password authentication process.
 // It verifies the user credentials and returns an AuthContext if successful.
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return a.AuthenticateConn(context.Background(), nil, reader, writer)
+}
+
+// AuthenticateConn performs the user/password authentication process for the connection described by meta.
+// If the credential store implements CredentialVerifier, the context and connection metadata are passed on to it
+// and the AuthContext it returns is used for the session.
+func (a UserPassAuthenticator) AuthenticateConn(ctx context.Context, meta *ConnMetadata, reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
 		return nil, err
@@ -120,7 +280,8 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
+	authContext, err := a.verify(ctx, meta, string(user), string(pass))
+	if err == nil {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return nil, err
 		}
@@ -128,26 +289,83 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
 			return nil, err
 		}
-		return nil, errUserAuthFailed
+		return nil, err
 	}
 
 	// Done
-	return &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": string(user)}}, nil
+	return authContext, nil
+}
+
+// verify checks the user credentials against the credential store.
+// It returns the AuthContext of the session, an error wrapping ErrCredentialsRejected if the
+// credentials are not valid, or an error wrapping errCredentialVerify if the store failed to
+// verify them.
+func (a UserPassAuthenticator) verify(ctx context.Context, meta *ConnMetadata, user, pass string) (*AuthContext, error) {
+	verifier, ok := a.Credentials.(CredentialVerifier)
+	if !ok {
+		if !a.Credentials.Valid(user, pass) {
+			return nil, errUserAuthFailed
+		}
+		return &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": user}}, nil
+	}
+
+	authContext, err := verifier.VerifyCredentials(ctx, meta, user, pass)
+	if errors.Is(err, ErrCredentialsRejected) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errCredentialVerify, err)
+	}
+	if authContext == nil {
+		return nil, errUserAuthFailed
+	}
+	authContext.Method = UserPassAuth
+	if authContext.Payload == nil {
+		authContext.Payload = make(map[string]string)
+	}
+	authContext.Payload["Username"] = user
+	return authContext, nil
 }
 
 // authenticate handles the connection authentication process.
-// It reads the methods supported by the client and selects a usable method.
-func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+// It reads the methods supported by the client and selects the method the server prefers
+// among those offered by the client.
+// meta describes the client connection and may be nil when it is unknown.
+func (s *Server) authenticate(ctx context.Context, meta *ConnMetadata, conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+	if meta == nil {
+		meta = &ConnMetadata{}
+	}
+
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get auth methods: %v", err)
 	}
-
-	// Select a usable method
+	offered := make(map[uint8]bool, len(methods))
 	for _, method := range methods {
+		offered[method] = true
+	}
+
+	// Select a usable method in the server's order of preference
+	preferred := s.authOrder
+	if s.config.AuthPolicy != nil {
+		preferred = s.config.AuthPolicy.Methods(ctx, meta)
+	}
+	for _, method := range preferred {
+		if !offered[method] {
+			continue
+		}
 		if cator, found := s.authMethods[method]; found {
-			return cator.Authenticate(bufConn, conn)
+			var authContext *AuthContext
+			if connCator, ok := cator.(ConnAuthenticator); ok {
+				authContext, err = connCator.AuthenticateConn(ctx, meta, bufConn, conn)
+			} else {
+				authContext, err = cator.Authenticate(bufConn, conn)
+			}
+			if errors.Is(err, errCredentialVerify) {
+				s.stats.authErrors.Add(1)
+			}
+			return authContext, err
 		}
 	}
 
@@ -2,6 +2,11 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
 	"testing"
 )
 
@@ -11,7 +16,7 @@ func TestNoAuth(t *testing.T) {
 	var resp bytes.Buffer
 
 	s, _ := New(&Config{})
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), nil, &resp, req)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -40,7 +45,7 @@ func TestPasswordAuth_Valid(t *testing.T) {
 
 	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), nil, &resp, req)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -76,7 +81,7 @@ func TestPasswordAuth_Invalid(t *testing.T) {
 	cator := UserPassAuthenticator{Credentials: cred}
 	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), nil, &resp, req)
 	if err != errUserAuthFailed {
 		t.Fatalf("err: %v", err)
 	}
@@ -103,7 +108,7 @@ func TestNoSupportedAuth(t *testing.T) {
 
 	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
 
-	ctx, err := s.authenticate(&resp, req)
+	ctx, err := s.authenticate(context.Background(), nil, &resp, req)
 	if err != errNoSupportedAuth {
 		t.Fatalf("err: %v", err)
 	}
@@ -117,3 +122,153 @@ func TestNoSupportedAuth(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+type addrCredentials struct {
+	allowed string
+}
+
+func (a addrCredentials) Valid(user, password string) bool {
+	return false
+}
+
+func (a addrCredentials) VerifyCredentials(ctx context.Context, meta *ConnMetadata, user, password string) (*AuthContext, error) {
+	if meta == nil || meta.RemoteAddr == nil || meta.RemoteAddr.String() != a.allowed {
+		return nil, fmt.Errorf("%w: source not allowed", ErrCredentialsRejected)
+	}
+	return &AuthContext{Payload: map[string]string{"Source": meta.RemoteAddr.String()}}, nil
+}
+
+func TestPasswordAuth_Verifier(t *testing.T) {
+	cator := UserPassAuthenticator{Credentials: addrCredentials{allowed: "10.0.0.1:1234"}}
+	s, _ := New(&Config{AuthMethods: []Authenticator{cator}})
+
+	for _, tc := range []struct {
+		remote string
+		status byte
+	}{
+		{"10.0.0.1:1234", authSuccess},
+		{"10.0.0.2:1234", authFailure},
+	} {
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{1, UserPassAuth})
+		req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+		var resp bytes.Buffer
+
+		remote, _ := net.ResolveTCPAddr("tcp", tc.remote)
+		ctx, err := s.authenticate(context.Background(), &ConnMetadata{RemoteAddr: remote}, &resp, req)
+		if tc.status == authFailure {
+			if !errors.Is(err, ErrCredentialsRejected) {
+				t.Fatalf("err: %v", err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if ctx.Method != UserPassAuth || ctx.Payload["Username"] != "foo" || ctx.Payload["Source"] != tc.remote {
+				t.Fatalf("bad context: %#v", ctx)
+			}
+		}
+
+		out := resp.Bytes()
+		if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, tc.status}) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+	if n := s.Stats().AuthErrors; n != 0 {
+		t.Fatalf("expect rejections not to count as errors, got %v", n)
+	}
+}
+
+type failingCredentials struct{}
+
+func (failingCredentials) Valid(user, password string) bool {
+	return false
+}
+
+func (failingCredentials) VerifyCredentials(ctx context.Context, meta *ConnMetadata, user, password string) (*AuthContext, error) {
+	return nil, errors.New("backend unreachable")
+}
+
+func TestPasswordAuth_VerifierError(t *testing.T) {
+	s, _ := New(&Config{AuthMethods: []Authenticator{UserPassAuthenticator{Credentials: failingCredentials{}}}})
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+	_, err := s.authenticate(context.Background(), nil, &resp, req)
+	if !errors.Is(err, errCredentialVerify) || !strings.Contains(err.Error(), "backend unreachable") {
+		t.Fatalf("expect verification error, got %v", err)
+	}
+	if out := resp.Bytes(); !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
+	if n := s.Stats().AuthErrors; n != 1 {
+		t.Fatalf("expect 1 auth error, got %v", n)
+	}
+}
+
+func TestServerPreferredAuth(t *testing.T) {
+	cred := StaticCredentials{
+		"foo": "bar",
+	}
+	s, _ := New(&Config{AuthMethods: []Authenticator{UserPassAuthenticator{Credentials: cred}, NoAuthAuthenticator{}}})
+
+	// The client prefers NoAuth, but the server prefers UserPassAuth
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{2, NoAuth, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	var resp bytes.Buffer
+
+	ctx, err := s.authenticate(context.Background(), nil, &resp, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Method != UserPassAuth {
+		t.Fatal("Invalid Context Method")
+	}
+}
+
+func TestSourceAuthPolicy(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cred := StaticCredentials{
+		"foo": "bar",
+	}
+	s, _ := New(&Config{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}, UserPassAuthenticator{Credentials: cred}},
+		AuthPolicy: &SourceAuthPolicy{
+			Rules:   []AuthRule{{Networks: []*net.IPNet{loopback}, Unix: true, Methods: []uint8{NoAuth, UserPassAuth}}},
+			Default: []uint8{UserPassAuth},
+		},
+	})
+
+	for _, tc := range []struct {
+		meta   *ConnMetadata
+		expect []byte
+	}{
+		{&ConnMetadata{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}}, []byte{socks5Version, NoAuth}},
+		{&ConnMetadata{RemoteAddr: &net.UnixAddr{Net: "unix"}, LocalAddr: &net.UnixAddr{Name: "/tmp/socks.sock", Net: "unix"}}, []byte{socks5Version, NoAuth}},
+		{&ConnMetadata{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}, []byte{socks5Version, UserPassAuth, 1, authSuccess}},
+	} {
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{2, NoAuth, UserPassAuth})
+		req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+		var resp bytes.Buffer
+
+		if _, err := s.authenticate(context.Background(), tc.meta, &resp, req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if out := resp.Bytes(); !bytes.Equal(out, tc.expect) {
+			t.Fatalf("bad: %v, expected %v", out, tc.expect)
+		}
+	}
+
+	// Only NoAuth offered from a remote network
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{1, NoAuth})
+	var resp bytes.Buffer
+	meta := &ConnMetadata{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}
+	if _, err := s.authenticate(context.Background(), meta, &resp, req); err != errNoSupportedAuth {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -1,23 +1,224 @@
 package socks5
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // BindCallBackFun is a function type for the callback that will be triggered when a bind operation is successful.
+//
+// Deprecated: Use Config.BindCallback.
 type BindCallBackFun func(bindAddr string)
 
 // BindCallBack is a global variable that stores the callback function for bind operations.
+// It is called with the listen address of the BIND requests of every server, after Config.BindCallback.
+//
+// Deprecated: Use Config.BindCallback, which is set per server and also reports the accepted
+// connection, or Server.BindListeners.
 var BindCallBack BindCallBackFun
 
+// BindEvent describes the progress of a BIND request, see Config.BindCallback.
+type BindEvent struct {
+	// Request is the BIND request.
+	Request *Request
+
+	// AuthContext is the authentication context of the client.
+	AuthContext *AuthContext
+
+	// BindAddr is the address the server listens on for the incoming connection.
+	BindAddr net.Addr
+
+	// Peer is the address of the accepted incoming connection, nil while the server is listening.
+	Peer net.Addr
+}
+
+// BindListener is a BIND request waiting for its incoming connection.
+type BindListener struct {
+	// ID identifies the listener within its server.
+	ID uint64
+
+	// Request is the BIND request.
+	Request *Request
+
+	// AuthContext is the authentication context of the client.
+	AuthContext *AuthContext
+
+	// Addr is the address the server listens on.
+	Addr net.Addr
+
+	// Created is the time the server started listening.
+	Created time.Time
+
+	listener net.Listener
+	mu       sync.Mutex
+	canceled bool
+}
+
+// Cancel stops listening. The client receives a failure reply.
+func (l *BindListener) Cancel() {
+	l.mu.Lock()
+	l.canceled = true
+	l.mu.Unlock()
+	l.listener.Close()
+}
+
+// isCanceled reports whether Cancel was called.
+func (l *BindListener) isCanceled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.canceled
+}
+
+// bindTable tracks the pending BIND listeners of a server. The zero value is ready to use.
+type bindTable struct {
+	mu        sync.Mutex
+	nextID    uint64
+	listeners map[uint64]*BindListener
+}
+
+// add registers a listener and assigns its ID.
+func (t *bindTable) add(l *BindListener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listeners == nil {
+		t.listeners = make(map[uint64]*BindListener)
+	}
+	t.nextID++
+	l.ID = t.nextID
+	t.listeners[l.ID] = l
+}
+
+// remove unregisters a listener.
+func (t *bindTable) remove(l *BindListener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.listeners, l.ID)
+}
+
+// get returns the listener with the given ID, or nil if there is none.
+func (t *bindTable) get(id uint64) *BindListener {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.listeners[id]
+}
+
+// list returns the pending listeners.
+func (t *bindTable) list() []*BindListener {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*BindListener, 0, len(t.listeners))
+	for _, l := range t.listeners {
+		list = append(list, l)
+	}
+	return list
+}
+
+// BindListeners returns the BIND requests of the server waiting for their incoming connection.
+func (s *Server) BindListeners() []*BindListener {
+	return s.binds.list()
+}
+
+// BindListener returns the pending BIND listener with the given ID, or nil if there is none.
+func (s *Server) BindListener(id uint64) *BindListener {
+	return s.binds.get(id)
+}
+
+// CancelBind cancels the pending BIND listener with the given ID.
+// It returns false if no such listener is pending.
+func (s *Server) CancelBind(id uint64) bool {
+	l := s.binds.get(id)
+	if l == nil {
+		return false
+	}
+	l.Cancel()
+	return true
+}
+
+// notifyBind calls Config.BindCallback, if provided, and the deprecated BindCallBack once the server listens.
+func (s *Server) notifyBind(req *Request, bindAddr, peer net.Addr) {
+	if s.config.BindCallback != nil {
+		s.config.BindCallback(BindEvent{Request: req, AuthContext: req.AuthContext, BindAddr: bindAddr, Peer: peer})
+	}
+	if peer == nil && BindCallBack != nil {
+		BindCallBack(bindAddr.String())
+	}
+}
+
+// acceptBindPeer reports whether a connection from peer is the one expected by a BIND request.
+// The peer must have the IP of DST.ADDR, unless it is unspecified, and the port of DST.PORT
+// if Config.BindMatchPort is set. The peer must also be permitted by the rules.
+func (s *Server) acceptBindPeer(ctx context.Context, req *Request, peer net.Addr) bool {
+	addr, ok := peer.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	expected := req.realDestAddr
+	if expected == nil {
+		expected = req.DestAddr
+	}
+	if expected != nil && len(expected.IP) != 0 && !expected.IP.IsUnspecified() && !expected.IP.Equal(addr.IP) {
+		return false
+	}
+	if s.config.BindMatchPort && expected != nil && expected.Port != 0 && expected.Port != addr.Port {
+		return false
+	}
+
+	// Check the actual peer like a destination
+	peerReq := &Request{
+		Version:      req.Version,
+		Command:      BindCommand,
+		AuthContext:  req.AuthContext,
+		RemoteAddr:   req.RemoteAddr,
+		DestAddr:     &AddrSpec{IP: addr.IP, Port: addr.Port},
+		realDestAddr: &AddrSpec{IP: addr.IP, Port: addr.Port},
+		session:      req.session,
+	}
+	_, ok = s.allow(ctx, peerReq)
+	return ok
+}
+
+// watchBindControl cancels a pending BIND listener when the client closes the control connection
+// while the server waits for the incoming connection. The returned function stops watching,
+// after which the control connection can be read again.
+func watchBindControl(conn conn, req *Request, pending *BindListener) func() {
+	br, ok := req.bufConn.(*bufio.Reader)
+	if !ok {
+		return func() {}
+	}
+	dl, ok := conn.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := br.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// Stopped watching
+				return
+			}
+			pending.Cancel()
+		}
+	}()
+	return func() {
+		dl.SetReadDeadline(time.Now())
+		<-done
+		dl.SetReadDeadline(time.Time{})
+	}
+}
+
 // doBind handles the BIND command of the SOCKS5 protocol.
-// It listens on a random port, sends the bind address back to the client, and waits for an incoming connection.
+// It listens on a port, see Config.ListenIP and Config.ListenPorts, sends the bind address back to the client,
+// and waits for an incoming connection from the destination of the request, see acceptBindPeer.
+// Other connections are dropped. Closing the control connection cancels the request. If Config.BindAcceptTimeout elapses first, a TTL expired reply is sent.
 func doBind(ctx context.Context, s *Server, conn conn, req *Request) error {
-	// Listen on a random TCP port.
-	listenTcp, err := net.Listen("tcp", "0.0.0.0:0")
+	// Listen on a TCP port.
+	listenTcp, err := s.listenTCP(conn)
 	if err != nil {
 		s.config.Logger.Printf("doBind Listen fail: %v\n", err)
 		sendReply(conn, serverFailure, nil)
@@ -25,44 +226,64 @@ func doBind(ctx context.Context, s *Server, conn conn, req *Request) error {
 	}
 	defer listenTcp.Close()
 	s.config.Logger.Printf("doBind Listen %v\n", listenTcp.Addr().String())
-	if BindCallBack != nil {
-		BindCallBack(listenTcp.Addr().String())
-	}
 
-	// Extract the bound port from the listener address.
-	_, port, err := net.SplitHostPort(listenTcp.Addr().String())
-	if err != nil {
-		return fmt.Errorf("doBind Failed to SplitHostPort: %v", err)
+	// Register the listener until the incoming connection is accepted, so it can be listed and canceled.
+	pending := &BindListener{
+		Request:     req,
+		AuthContext: req.AuthContext,
+		Addr:        listenTcp.Addr(),
+		Created:     time.Now(),
+		listener:    listenTcp,
 	}
-	bindPort, _ := strconv.Atoi(port)
+	s.binds.add(pending)
+	defer s.binds.remove(pending)
+	s.notifyBind(req, listenTcp.Addr(), nil)
 
 	// Send the bind address back to the client.
-	bindAddr := AddrSpec{IP: s.config.BindIP, Port: bindPort}
-	if err = sendReply(conn, successReply, &bindAddr); err != nil {
+	bindAddr := s.advertisedAddr(conn, listenTcp.Addr())
+	if err = sendReply(conn, successReply, bindAddr); err != nil {
 		return fmt.Errorf("doBind Failed to send reply: %v", err)
 	}
 
-	// Accept an incoming connection.
+	// Give up if no permitted connection arrives in time.
+	if timeout := s.config.BindAcceptTimeout; timeout > 0 {
+		if l, ok := listenTcp.(*net.TCPListener); ok {
+			l.SetDeadline(time.Now().Add(timeout))
+		}
+	}
+
+	// Accept an incoming connection from the destination of the request.
+	stopWatch := watchBindControl(conn, req, pending)
 	var tcpConn net.Conn
 	for {
 		tcpConn, err = listenTcp.Accept()
 		if err != nil {
 			s.config.Logger.Printf("doBind Accept fail: %v\n", err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				sendReply(conn, ttlExpired, nil)
+				return fmt.Errorf("doBind no connection from %v within %v", req.DestAddr, s.config.BindAcceptTimeout)
+			}
 			sendReply(conn, serverFailure, nil)
+			if pending.isCanceled() {
+				return fmt.Errorf("doBind listener %v canceled", pending.ID)
+			}
 			return err
 		}
 
-		// TODO: Consider implementing IP restriction to only accept connections from the target IP.
-		// remoteIp, _, _ := net.SplitHostPort(tcpConn.RemoteAddr().String())
-		// if remoteIp != req.DestAddr.IP.String() {
-		// 	tcpConn.Close()
-		// 	continue
-		// }
+		if !s.acceptBindPeer(ctx, req, tcpConn.RemoteAddr()) {
+			s.stats.bindPeersDropped.Add(1)
+			s.config.Logger.Printf("[WARN] socks: Dropped BIND connection from %v, expected %v", tcpConn.RemoteAddr(), req.DestAddr)
+			tcpConn.Close()
+			continue
+		}
 
 		s.config.Logger.Printf("doBind accept one connection from %v\n", tcpConn.RemoteAddr().String())
 		break
 	}
 	defer tcpConn.Close()
+	stopWatch()
+	s.binds.remove(pending)
+	s.notifyBind(req, listenTcp.Addr(), tcpConn.RemoteAddr())
 
 	// Extract the remote IP and port from the accepted connection.
 	remoteIp, port, err := net.SplitHostPort(tcpConn.RemoteAddr().String())
@@ -2,7 +2,9 @@ package socks5
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -20,11 +22,25 @@ func TestSocks5_Bind(t *testing.T) {
 	}
 	// Create an authenticator using the static credentials
 	cator := UserPassAuthenticator{Credentials: creds}
+	// Define a callback to capture the bind port of the SOCKS5 server
+	bindPorts := make(chan int, 1)
+	cb := func(event BindEvent) {
+		if event.Peer != nil {
+			return
+		}
+		_, port, err := net.SplitHostPort(event.BindAddr.String())
+		if err == nil {
+			fmt.Printf("SOCKS5 server bind port %v\n", port)
+			p, _ := strconv.Atoi(port)
+			bindPorts <- p
+		}
+	}
 	// Configure the SOCKS5 server
 	conf := &Config{
-		AuthMethods: []Authenticator{cator},
-		BindIP:      net.ParseIP("127.0.0.1"),
-		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		AuthMethods:  []Authenticator{cator},
+		BindIP:       net.ParseIP("127.0.0.1"),
+		Logger:       log.New(os.Stdout, "", log.LstdFlags),
+		BindCallback: cb,
 	}
 	// Create a new SOCKS5 server with the given configuration
 	serv, err := New(conf)
@@ -32,35 +48,25 @@ func TestSocks5_Bind(t *testing.T) {
 		t.Fatalf("Failed to create SOCKS5 server: %v", err)
 		return
 	}
-	// Start the server in a separate goroutine
-	go func() {
-		if err := serv.ListenAndServe("tcp", "127.0.0.1:12367"); err != nil {
-			t.Errorf("Failed to start SOCKS5 server: %v", err)
-		}
-	}()
-
-	// Define a callback to capture the bind port of the SOCKS5 server
-	var socks5ServerBindPort int
-	cb := func(bindAddr string) {
-		_, port, err := net.SplitHostPort(bindAddr)
-		if err == nil {
-			fmt.Printf("SOCKS5 server bind port %v\n", port)
-			socks5ServerBindPort, _ = strconv.Atoi(port)
-		}
+	// Start the server on a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start SOCKS5 server: %v", err)
 	}
-	BindCallBack = cb
-
-	// Wait for the server to bind to the port
-	time.Sleep(10 * time.Millisecond)
+	defer l.Close()
+	go serv.Serve(l)
 
 	// Create a SOCKS5 dialer to connect to the server
-	dial, err := NewDialer("socks5://127.0.0.1:12367")
+	dial, err := NewDialer("socks5://" + l.Addr().String())
 	if err != nil {
 		t.Fatalf("Failed to create SOCKS5 dialer: %v", err)
 		return
 	}
 	dial.Username = "foo"
 	dial.Password = "bar"
+	// The goroutine accepting the connection ends once the listener is closed
+	var wg sync.WaitGroup
+	defer wg.Wait()
 	// Create a listener to bind to a local port
 	listener, err := dial.Listen(context.Background(), "tcp", ":12000")
 	if err != nil {
@@ -73,7 +79,6 @@ func TestSocks5_Bind(t *testing.T) {
 	errCh := make(chan error, 1)
 
 	// Wait for a connection from the SOCKS5 server
-	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -95,11 +100,13 @@ func TestSocks5_Bind(t *testing.T) {
 			errCh <- fmt.Errorf("failed to read from client: %v", err)
 		}
 	}()
-	defer wg.Wait()
 
 	// Wait for the bind port to be set
-	for socks5ServerBindPort == 0 {
-		time.Sleep(time.Millisecond)
+	var socks5ServerBindPort int
+	select {
+	case socks5ServerBindPort = <-bindPorts:
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the bind port")
 	}
 
 	// Connect to the bound port of the SOCKS5 server
@@ -135,3 +142,355 @@ func TestSocks5_Bind(t *testing.T) {
 		// No error
 	}
 }
+
+// denyPeerRule denies BIND peers with the given IP.
+type denyPeerRule struct {
+	ip net.IP
+}
+
+func (r denyPeerRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, req.Command != BindCommand || !r.ip.Equal(req.DestAddr.IP)
+}
+
+// startBind sends a BIND request for dst to a new server and returns the control connection
+// and the address the server listens on.
+func startBind(t *testing.T, conf *Config, dst string) (*Server, net.Conn, *address) {
+	serv, server := startServer(t, "tcp", "127.0.0.1:0", conf)
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d := &Dialer{}
+	if err := d.connectAuth(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	bound, err := d.connectCommand(conn, BindCommand, dst)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return serv, conn, bound.(*address)
+}
+
+// dialFrom connects to addr from the given local IP.
+func dialFrom(t *testing.T, ip string, addr *address) net.Conn {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	conn, err := d.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestSocks5_Bind_RestrictPeer(t *testing.T) {
+	serv, ctrl, bound := startBind(t, &Config{Rules: denyPeerRule{net.ParseIP("127.0.0.3")}}, "127.0.0.2:0")
+
+	// A connection from another IP is dropped
+	stranger := dialFrom(t, "127.0.0.1", bound)
+	stranger.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err := stranger.Read(buf[:]); err == nil {
+		t.Fatalf("expect connection from other IP to be closed")
+	}
+	if n := serv.Stats().BindPeersDropped; n != 1 {
+		t.Fatalf("expect 1 dropped peer, got %v", n)
+	}
+
+	// The destination of the request is accepted
+	peer := dialFrom(t, "127.0.0.2", bound)
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	addr, err := (&Dialer{}).readReply(ctrl)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("expect peer %v, got %v", peer.LocalAddr(), addr)
+	}
+	peer.Write([]byte("ping"))
+	var resp [4]byte
+	if _, err := io.ReadFull(ctrl, resp[:]); err != nil || string(resp[:]) != "ping" {
+		t.Fatalf("bad data %q: %v", resp, err)
+	}
+}
+
+func TestSocks5_Bind_RulesCheckPeer(t *testing.T) {
+	serv, ctrl, bound := startBind(t, &Config{Rules: denyPeerRule{net.ParseIP("127.0.0.3")}}, "0.0.0.0:0")
+
+	// Without destination IP, any peer permitted by the rules is accepted
+	denied := dialFrom(t, "127.0.0.3", bound)
+	denied.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err := denied.Read(buf[:]); err == nil {
+		t.Fatalf("expect denied connection to be closed")
+	}
+	if n := serv.Stats().BindPeersDropped; n != 1 {
+		t.Fatalf("expect 1 dropped peer, got %v", n)
+	}
+
+	peer := dialFrom(t, "127.0.0.4", bound)
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	addr, err := (&Dialer{}).readReply(ctrl)
+	if err != nil || addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("expect peer %v, got %v: %v", peer.LocalAddr(), addr, err)
+	}
+}
+
+func TestSocks5_Bind_MatchPort(t *testing.T) {
+	_, ctrl, bound := startBind(t, &Config{BindMatchPort: true}, "127.0.0.1:1")
+
+	// The port of the peer does not match
+	peer := dialFrom(t, "127.0.0.1", bound)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err := peer.Read(buf[:]); err == nil {
+		t.Fatalf("expect connection from other port to be closed")
+	}
+	ctrl.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := ctrl.Read(buf[:]); err == nil {
+		t.Fatalf("expect no reply")
+	}
+}
+
+func TestSocks5_Bind_AcceptTimeout(t *testing.T) {
+	_, ctrl, _ := startBind(t, &Config{BindAcceptTimeout: 50 * time.Millisecond}, "127.0.0.2:0")
+
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	var header [2]byte
+	if _, err := io.ReadFull(ctrl, header[:]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if header[1] != ttlExpired {
+		t.Fatalf("expect TTL expired reply, got %v", header[1])
+	}
+}
+
+func TestSocks5_BindListeners(t *testing.T) {
+	events := make(chan BindEvent, 2)
+	serv, ctrl, bound := startBind(t, &Config{
+		BindCallback: func(event BindEvent) { events <- event },
+	}, "127.0.0.1:0")
+
+	event := <-events
+	if event.Peer != nil || event.BindAddr.(*net.TCPAddr).Port != bound.Port || event.Request.Command != BindCommand {
+		t.Fatalf("bad listen event: %+v", event)
+	}
+	if event.AuthContext == nil || event.AuthContext.Method != NoAuth {
+		t.Fatalf("bad auth context: %+v", event.AuthContext)
+	}
+
+	listeners := serv.BindListeners()
+	if len(listeners) != 1 || listeners[0].Addr.String() != event.BindAddr.String() {
+		t.Fatalf("bad listeners: %v", listeners)
+	}
+	if l := serv.BindListener(listeners[0].ID); l != listeners[0] {
+		t.Fatalf("bad listener: %v", l)
+	}
+
+	// Canceling fails the request
+	if !serv.CancelBind(listeners[0].ID) {
+		t.Fatalf("expect listener to be canceled")
+	}
+	ctrl.SetReadDeadline(time.Now().Add(time.Second))
+	var header [2]byte
+	if _, err := io.ReadFull(ctrl, header[:]); err != nil || header[1] != serverFailure {
+		t.Fatalf("expect failure reply, got %v: %v", header, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(serv.BindListeners()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(serv.BindListeners()); n != 0 {
+		t.Fatalf("expect no listeners, got %v", n)
+	}
+	if serv.CancelBind(listeners[0].ID) {
+		t.Fatalf("expect listener to be gone")
+	}
+}
+
+func TestSocks5_BindCallback_Peer(t *testing.T) {
+	events := make(chan BindEvent, 2)
+	serv, _, bound := startBind(t, &Config{
+		BindCallback: func(event BindEvent) { events <- event },
+	}, "127.0.0.1:0")
+	<-events
+
+	peer := dialFrom(t, "127.0.0.1", bound)
+	select {
+	case event := <-events:
+		if event.Peer.String() != peer.LocalAddr().String() {
+			t.Fatalf("expect peer %v, got %v", peer.LocalAddr(), event.Peer)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect accept event")
+	}
+	if n := len(serv.BindListeners()); n != 0 {
+		t.Fatalf("expect accepted listener to be removed, got %v", n)
+	}
+}
+
+func TestSocks5_BindCallBack_Deprecated(t *testing.T) {
+	addrs := make(chan string, 1)
+	BindCallBack = func(bindAddr string) { addrs <- bindAddr }
+	defer func() { BindCallBack = nil }()
+
+	_, _, bound := startBind(t, &Config{}, "127.0.0.1:0")
+	select {
+	case addr := <-addrs:
+		if _, port, _ := net.SplitHostPort(addr); port != strconv.Itoa(bound.Port) {
+			t.Fatalf("expect port %v, got %v", bound.Port, addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect BindCallBack to be called")
+	}
+}
+
+// waitBindListeners waits until the server has n pending BIND listeners.
+func waitBindListeners(t *testing.T, serv *Server, n int) []*BindListener {
+	deadline := time.Now().Add(time.Second)
+	for {
+		listeners := serv.BindListeners()
+		if len(listeners) == n {
+			return listeners
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %v listeners, got %v", n, len(listeners))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialer_Listen(t *testing.T) {
+	serv, err := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	dial := &Dialer{ProxyNetwork: "tcp", ProxyAddress: l.Addr().String()}
+	ln, err := dial.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+
+	// The BIND request is sent by Listen
+	for i := 0; i < 2; i++ {
+		addr, ok := ln.Addr().(*address)
+		if !ok || addr.Port == 0 {
+			t.Fatalf("bad listener address: %v", ln.Addr())
+		}
+		listeners := waitBindListeners(t, serv, 1)
+		if port := listeners[0].Addr.(*net.TCPAddr).Port; port != addr.Port {
+			t.Fatalf("expect port %v, got %v", port, addr.Port)
+		}
+
+		peer, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", addr.Port))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer peer.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		if conn.RemoteAddr().String() != peer.LocalAddr().String() {
+			t.Fatalf("expect remote %v, got %v", peer.LocalAddr(), conn.RemoteAddr())
+		}
+		peer.Write([]byte("ping"))
+		var buf [4]byte
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, buf[:]); err != nil || string(buf[:]) != "ping" {
+			t.Fatalf("bad read %q: %v", buf, err)
+		}
+
+		// Accept renews the BIND request for the next connection
+		waitListenerRenewed(t, ln, addr.Port)
+	}
+
+	// Close cancels a pending Accept and the BIND request on the server
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ln.Close()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expect net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Accept not canceled")
+	}
+	waitBindListeners(t, serv, 0)
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect net.ErrClosed, got %v", err)
+	}
+}
+
+// waitListenerRenewed waits until the listener of a Dialer no longer listens on port.
+func waitListenerRenewed(t *testing.T, ln net.Listener, port int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for ln.Addr().(*address).Port == port {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect a new address, got %v", ln.Addr())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDialer_ListenRenew(t *testing.T) {
+	serv, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// The context of Listen only applies to the first BIND request
+	ctx, cancel := context.WithCancel(context.Background())
+	dial := &Dialer{ProxyNetwork: "tcp", ProxyAddress: l.Addr().String(), Timeout: time.Second}
+	ln, err := dial.Listen(ctx, "tcp", "127.0.0.1:0")
+	cancel()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+
+	accept := func() int {
+		t.Helper()
+		port := ln.Addr().(*address).Port
+		peer, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer peer.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+		return port
+	}
+	waitListenerRenewed(t, ln, accept())
+
+	// A connection is returned even if the renewal fails, which the next Accept reports
+	l.Close()
+	accept()
+	if _, err := ln.Accept(); err == nil || errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect renewal error, got %v", err)
+	}
+}
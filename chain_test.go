@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChain_Dial(t *testing.T) {
+	echo := startTCPEcho(t)
+	_, a := startServer(t, "tcp", "127.0.0.1:0", &Config{Credentials: StaticCredentials{"alice": "a"}})
+	_, b := startServer(t, "tcp", "127.0.0.1:0", &Config{Credentials: StaticCredentials{"bob": "b"}})
+
+	chain, err := ParseChain("socks5://alice:a@" + a + "?timeout=5s, socks5h://bob:b@" + b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(chain.Hops) != 2 || chain.Hops[0].Timeout != 5*time.Second || !chain.Hops[0].IsResolve || chain.Hops[1].IsResolve {
+		t.Fatalf("bad chain: %+v %+v", chain.Hops[0], chain.Hops[1])
+	}
+
+	conn, err := chain.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+}
+
+func TestChain_NoProxy(t *testing.T) {
+	echo := startTCPEcho(t)
+	closed := closedAddr(t)
+
+	// Destinations bypassed by the first hop are dialed directly, the other hops are not used
+	chain, err := ParseChain("socks5://" + closed + ",socks5://" + closed)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	chain.Hops[0].NoProxy = ParseNoProxy("127.0.0.1")
+	chain.Hops[1].NoProxy = ParseNoProxy("*")
+	conn, err := chain.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+
+	// The NoProxy of later hops is ignored
+	chain.Hops[0].NoProxy = nil
+	if _, err := chain.Dial("tcp", echo); err == nil {
+		t.Fatalf("expect chain to fail through closed hops")
+	}
+}
+
+func TestChain_HopError(t *testing.T) {
+	echo := startTCPEcho(t)
+	_, a := startServer(t, "tcp", "127.0.0.1:0", &Config{Credentials: StaticCredentials{"alice": "a"}})
+	_, b := startServer(t, "tcp", "127.0.0.1:0", &Config{Credentials: StaticCredentials{"bob": "b"}})
+	closed := closedAddr(t)
+
+	cases := []struct {
+		chain string
+		addr  string
+		hop   int
+		proxy string
+	}{
+		{"socks5://alice:a@" + closed + ",socks5://bob:b@" + b, echo, 1, closed},
+		{"socks5://alice:a@" + a + ",socks5://bob:wrong@" + b, echo, 2, b},
+		{"socks5://alice:a@" + a + ",socks5://bob:b@" + closed, echo, 1, a},
+		{"socks5://alice:a@" + a + ",socks5://bob:b@" + b, closed, 2, b},
+	}
+	for _, c := range cases {
+		chain, err := ParseChain(c.chain)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_, err = chain.Dial("tcp", c.addr)
+		var hopErr *HopError
+		if !errors.As(err, &hopErr) || hopErr.Hop != c.hop || hopErr.Proxy != c.proxy {
+			t.Errorf("%v: expect hop %v (%v) to fail, got %v", c.chain, c.hop, c.proxy, err)
+		}
+	}
+
+	// The last hop reports the reply of its proxy server
+	chain, _ := ParseChain("socks5://alice:a@" + a + ",socks5://bob:b@" + b)
+	_, err := chain.Dial("tcp", closed)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != connectionRefused {
+		t.Fatalf("expect connection refused reply, got %v", err)
+	}
+
+	if _, err := ParseChain("socks5://" + a + ",http://" + b); err == nil || err.Error() != "socks5 chain hop 2: unsupported protocol 'http'" {
+		t.Fatalf("expect hop 2 parse error, got %v", err)
+	}
+}
@@ -18,6 +18,9 @@ type Client struct {
 	TCPTimeout    int
 	UDPTimeout    int
 	Dst           string
+	// On cmd UDP, payloads larger than FragmentSize are sent as fragments, zero disables fragmentation
+	FragmentSize int
+	reasm        *reassembler
 }
 
 // This is just create a client, you need to use Dial to create conn
@@ -47,6 +50,7 @@ func (c *Client) DialWithLocalAddr(network, src, dst string, remoteAddr net.Addr
 		UDPTimeout:    c.UDPTimeout,
 		Dst:           dst,
 		RemoteAddress: remoteAddr,
+		FragmentSize:  c.FragmentSize,
 	}
 	var err error
 	if network == "tcp" {
@@ -116,16 +120,29 @@ func (c *Client) Read(b []byte) (int, error) {
 	if c.UDPConn == nil {
 		return c.TCPConn.Read(b)
 	}
-	n, err := c.UDPConn.Read(b)
-	if err != nil {
-		return 0, err
+	if c.reasm == nil {
+		c.reasm = newReassembler(0, 0)
 	}
-	d, err := NewDatagramFromBytes(b[0:n])
-	if err != nil {
-		return 0, err
+	for {
+		n, err := c.UDPConn.Read(b)
+		if err != nil {
+			return 0, err
+		}
+		d, err := NewDatagramFromBytes(b[0:n])
+		if err != nil {
+			return 0, err
+		}
+		if d.Frag == 0 {
+			c.reasm.reset()
+			n = copy(b, d.Data)
+			return n, nil
+		}
+		// Fragmented datagrams are returned once reassembled
+		if data, done := c.reasm.add(d.Frag, d.Address(), d.Data); done {
+			n = copy(b, data)
+			return n, nil
+		}
 	}
-	n = copy(b, d.Data)
-	return n, nil
 }
 
 func (c *Client) Write(b []byte) (int, error) {
@@ -139,14 +156,21 @@ func (c *Client) Write(b []byte) (int, error) {
 	if a == ATYPDomain {
 		h = h[1:]
 	}
-	d := NewDatagramC(a, h, p, b)
-	b1 := d.Bytes()
-	n, err := c.UDPConn.Write(b1)
+	parts, frags, err := fragmentPayload(b, c.FragmentSize)
 	if err != nil {
 		return 0, err
 	}
-	if len(b1) != n {
-		return 0, errors.New("not write full")
+	for i, part := range parts {
+		d := NewDatagramC(a, h, p, part)
+		d.Frag = frags[i]
+		b1 := d.Bytes()
+		n, err := c.UDPConn.Write(b1)
+		if err != nil {
+			return 0, err
+		}
+		if len(b1) != n {
+			return 0, errors.New("not write full")
+		}
 	}
 	return len(b), nil
 }
@@ -248,7 +272,7 @@ func (c *Client) Request(r *RequestC) (*Reply, error) {
 		return nil, err
 	}
 	if rp.Rep != RepSuccess {
-		return nil, errors.New("Host unreachable")
+		return nil, &ReplyError{Code: rp.Rep}
 	}
 	return rp, nil
 }
@@ -40,18 +40,34 @@ func Command2String(cmd uint8) string {
 	}
 }
 
+// errToReply returns the reply code for an error of connecting to a destination.
+// Timeouts are reported as TTL expired, errors without a more specific code as host unreachable.
 func errToReply(err error) uint8 {
-	if err == nil {
+	var netErr net.Error
+	switch {
+	case err == nil:
 		return successReply
+	case errors.Is(err, errnoConnRefused):
+		return connectionRefused
+	case errors.Is(err, errnoNetUnreach):
+		return networkUnreachable
+	case errors.Is(err, errnoHostUnreach):
+		return hostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ttlExpired
+	default:
+		return hostUnreachable
 	}
-	msg := err.Error()
-	resp := hostUnreachable
-	if strings.Contains(msg, "refused") {
-		resp = connectionRefused
-	} else if strings.Contains(msg, "network is unreachable") {
-		resp = networkUnreachable
-	}
-	return resp
+}
+
+// ReplyError is the error of a request that the proxy server answered with a failure reply.
+// Use errors.As to inspect the reply code.
+type ReplyError struct {
+	Code uint8
+}
+
+func (e *ReplyError) Error() string {
+	return "socks5 reply: " + Reply2String(e.Code)
 }
 
 // reply is a SOCKS Command reply code.
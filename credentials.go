@@ -1,5 +1,9 @@
 package socks5
 
+import (
+	"context"
+)
+
 // CredentialStore is an interface used to support user/password authentication.
 // It provides a method to validate a user and password combination.
 type CredentialStore interface {
@@ -8,6 +12,22 @@ type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// CredentialVerifier is an optional interface a CredentialStore can implement to take part in
+// the user/password authentication with more context than Valid gets.
+//
+// When the store used by a UserPassAuthenticator implements CredentialVerifier, VerifyCredentials
+// is called instead of Valid. It receives the connection metadata, which may be nil when the
+// authenticator is used outside of a Server, and returns the AuthContext of the session.
+// The method and the "Username" payload entry are filled in by the authenticator.
+// Errors wrapping ErrCredentialsRejected reject the credentials, other errors are logged as
+// failures to verify them and counted in Stats.AuthErrors.
+type CredentialVerifier interface {
+	// VerifyCredentials checks the user and password of the connection described by meta.
+	// It returns an AuthContext if the credentials are valid, an error wrapping ErrCredentialsRejected
+	// if they are not, and any other error if they could not be verified.
+	VerifyCredentials(ctx context.Context, meta *ConnMetadata, user, password string) (*AuthContext, error)
+}
+
 // StaticCredentials is an implementation of the CredentialStore interface that uses a map to store user credentials.
 // It enables direct use of a map as a credential store.
 type StaticCredentials map[string]string
@@ -20,4 +40,4 @@ func (s StaticCredentials) Valid(user, password string) bool {
 		return false
 	}
 	return password == pass
-}
\ No newline at end of file
+}
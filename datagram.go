@@ -68,6 +68,25 @@ func (d *Datagram) Address() string {
 	return net.JoinHostPort(s, p)
 }
 
+// addrSpec returns the destination of the datagram.
+func (d *Datagram) addrSpec() *AddrSpec {
+	spec := &AddrSpec{Port: int(binary.BigEndian.Uint16(d.DstPort))}
+	if d.ATyp == fqdnAddress {
+		spec.FQDN = string(d.DstAddr[1:])
+	} else {
+		spec.IP = append(net.IP{}, d.DstAddr...)
+	}
+	return spec
+}
+
+// host returns DstAddr without the length prefix of a domain name, as expected by NewDatagram.
+func (d *Datagram) host() []byte {
+	if d.ATyp == fqdnAddress {
+		return d.DstAddr[1:]
+	}
+	return d.DstAddr
+}
+
 // SOCKS5 UDP Datagram Format:
 // https://datatracker.ietf.org/doc/html/rfc1928#section-7
 func NewDatagramFromByte(ctx context.Context, memCreater MemAllocation, bs []byte) (*Datagram, error) {
@@ -79,9 +98,9 @@ func NewDatagramFromByte(ctx context.Context, memCreater MemAllocation, bs []byt
 	}
 
 	frag := bs[2]
-	if frag != 0x00 {
-		// Fragmentation is not supported
-		return nil, fmt.Errorf("Datagram Not Support Slice Transmission")
+	if frag == fragEnd {
+		// The end flag without a fragment position
+		return nil, fmt.Errorf("Datagram Illegal")
 	}
 
 	aTyp := bs[3]
@@ -118,7 +137,8 @@ func NewDatagramFromByte(ctx context.Context, memCreater MemAllocation, bs []byt
 		if dataLen < needLen {
 			return nil, fmt.Errorf("Datagram Illegal")
 		}
-		dstAddr = bs[needLen-domainLen : needLen]
+		// Keep the length prefix, like NewDatagram does
+		dstAddr = bs[needLen-domainLen-1 : needLen]
 	default:
 		return nil, fmt.Errorf("Datagram Illegal")
 	}
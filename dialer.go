@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -34,20 +35,33 @@ type Dialer struct {
 	// Timeout is the maximum amount of time a dial will wait for
 	// a connect to complete. The default is no timeout
 	Timeout time.Duration
+	// UDPFragmentSize is the maximum payload of a datagram sent to the proxy server,
+	// larger payloads are fragmented. Zero disables fragmentation
+	UDPFragmentSize int
+	// NoProxy optionally specifies the destinations that DialContext dials directly
+	// with ProxyDial instead of through the proxy server
+	NoProxy *NoProxy
 }
 
 // NewDialer returns a new Dialer that dials through the provided
 // proxy server's network and address.
+// The optional query parameter "timeout" overrides the default Timeout of a minute, e.g. "?timeout=10s".
 func NewDialer(addr string) (*Dialer, error) {
-	d := &Dialer{
-		ProxyNetwork: "tcp",
-		Timeout:      time.Minute,
-	}
 	u, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
+	return newDialerFromURL(u, u.Scheme)
+}
+
+// newDialerFromURL returns a new Dialer for a proxy URL whose scheme is treated as scheme,
+// either "socks5" to resolve domain names locally or "socks5h" to let the proxy server resolve them.
+func newDialerFromURL(u *url.URL, scheme string) (*Dialer, error) {
+	d := &Dialer{
+		ProxyNetwork: "tcp",
+		Timeout:      time.Minute,
+	}
+	switch scheme {
 	case "socks5":
 		d.IsResolve = true
 	case "socks5h":
@@ -65,12 +79,22 @@ func NewDialer(addr string) (*Dialer, error) {
 		d.Username = u.User.Username()
 		d.Password, _ = u.User.Password()
 	}
+	if timeout := u.Query().Get("timeout"); timeout != "" {
+		var err error
+		d.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout '%s': %v", timeout, err)
+		}
+	}
 	d.ProxyAddress = host
 	return d, nil
 }
 
 // DialContext connects to the provided address on the provided network.
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.NoProxy.Match(address) {
+		return d.proxyDial(ctx, network, address)
+	}
 	switch network {
 	default:
 		return nil, fmt.Errorf("unsupported network %q", network)
@@ -92,11 +116,36 @@ func (d *Dialer) Listen(ctx context.Context, network, address string) (net.Liste
 		return nil, fmt.Errorf("unsupported network %q", network)
 	case "tcp", "tcp4", "tcp6":
 	}
-	return &listener{ctx: ctx, d: d, address: address}, nil
+	l := &listener{d: d, address: address}
+	if err := l.bind(ctx); err != nil {
+		return nil, err
+	}
+	// The BIND request is renewed after every connection, until the listener is closed
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l, nil
+}
+
+// ListenPacket associates with the proxy server and returns the association as a net.PacketConn,
+// which sends to and receives from any destination, see UDPConn.
+// It is closed when the proxy server closes the control connection.
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	conn, err := d.do(ctx, AssociateCommand, "")
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*UDPConn), nil
 }
 
 func (d *Dialer) do(ctx context.Context, cmd uint8, address string) (net.Conn, error) {
-	if d.IsResolve {
+	if d.Timeout != 0 {
+		deadline := time.Now().Add(d.Timeout)
+		if d, ok := ctx.Deadline(); !ok || deadline.Before(d) {
+			subCtx, cancel := context.WithDeadline(ctx, deadline)
+			defer cancel()
+			ctx = subCtx
+		}
+	}
+	if d.IsResolve && address != "" {
 		host, port, err := net.SplitHostPort(address)
 		if err != nil {
 			return nil, err
@@ -122,24 +171,45 @@ func (d *Dialer) do(ctx context.Context, cmd uint8, address string) (net.Conn, e
 		return nil, err
 	}
 
-	return d.connect(ctx, conn, cmd, address)
+	c, err := d.connect(ctx, conn, cmd, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
-func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd uint8, address string) (net.Conn, error) {
-	if d.Timeout != 0 {
-		deadline := time.Now().Add(d.Timeout)
-		if d, ok := ctx.Deadline(); !ok || deadline.Before(d) {
-			subCtx, cancel := context.WithDeadline(ctx, deadline)
-			defer cancel()
-			ctx = subCtx
-		}
-	}
+func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd uint8, address string) (c net.Conn, err error) {
 	if deadline, ok := ctx.Deadline(); ok && !deadline.IsZero() {
 		conn.SetDeadline(deadline)
 		defer conn.SetDeadline(time.Time{})
 	}
 
-	err := d.connectAuth(conn)
+	// Abort the handshake when the context is canceled
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		canceled := make(chan error, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Unix(1, 0))
+				canceled <- ctx.Err()
+			case <-done:
+				canceled <- nil
+			}
+		}()
+		defer func() {
+			close(done)
+			if ctxErr := <-canceled; ctxErr != nil {
+				if c != nil && c != conn {
+					c.Close()
+				}
+				c, err = nil, ctxErr
+			}
+		}()
+	}
+
+	err = d.connectAuth(conn)
 	if err != nil {
 		return nil, err
 	}
@@ -154,15 +224,19 @@ func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd uint8, address
 		}
 		return conn, nil
 	case BindCommand:
-		_, err := d.connectCommand(conn, BindCommand, address)
+		addr, err := d.connectCommand(conn, BindCommand, address)
 		if err != nil {
 			return nil, err
 		}
-		return conn, nil
+		return &bindConn{Conn: conn, bindAddr: addr}, nil
 	case AssociateCommand:
-		targetIP, targetPort, err := splitHostPort(address)
-		if err != nil {
-			return nil, err
+		// An empty address associates without a default target, see ListenPacket
+		var targetAddr net.Addr
+		if address != "" {
+			targetAddr, err = udpTarget(address)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		addr, err := d.connectCommand(conn, AssociateCommand, ":0")
@@ -180,10 +254,6 @@ func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd uint8, address
 			return nil, err
 		}
 
-		targetAddr := &net.UDPAddr{
-			IP:   net.ParseIP(targetIP),
-			Port: targetPort,
-		}
 		proxyAddr := &net.UDPAddr{
 			IP:   net.ParseIP(proxyIP),
 			Port: proxyPort,
@@ -192,6 +262,8 @@ func (d *Dialer) connect(ctx context.Context, conn net.Conn, cmd uint8, address
 		if err != nil {
 			return nil, err
 		}
+		wrapConn.FragmentSize = d.UDPFragmentSize
+		wrapConn.control = conn
 
 		go func() {
 			var buf [1]byte
@@ -300,7 +372,7 @@ func (d *Dialer) readReply(conn net.Conn) (net.Addr, error) {
 	}
 
 	if uint8(header[1]) != successReply {
-		return nil, fmt.Errorf("unknown error %s", Reply2String(uint8(header[1])))
+		return nil, &ReplyError{Code: uint8(header[1])}
 	}
 
 	return readAddr(conn)
@@ -331,33 +403,144 @@ func (d *Dialer) proxyPacketDial(ctx context.Context, network, address string) (
 	return proxyPacketDial(ctx, network, address)
 }
 
+// listener accepts connections through BIND requests, one request per connection.
+// A BIND request is always pending, so Addr reports where the next connection is expected.
 type listener struct {
-	ctx     context.Context
+	ctx     context.Context // Context of the renewed BIND requests, canceled by Close
+	cancel  context.CancelFunc
 	d       *Dialer
 	address string
+
+	acceptMu sync.Mutex // Serializes Accept
+	mu       sync.Mutex
+	conn     net.Conn      // Control connection of the pending BIND request, nil if there is none
+	addr     net.Addr      // Address the proxy listens on for the pending BIND request
+	renewing chan struct{} // Closed when the renewal of the BIND request finished
+	err      error         // Error of the last renewal
+	closed   bool
+}
+
+// bindConn is the control connection of a BIND request after the first reply.
+type bindConn struct {
+	net.Conn
+	bindAddr net.Addr
+}
+
+// bind sends a new BIND request and makes it the pending one.
+func (l *listener) bind(ctx context.Context) error {
+	conn, err := l.d.do(ctx, BindCommand, l.address)
+	if err != nil {
+		return err
+	}
+	bc := conn.(*bindConn)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		bc.Conn.Close()
+		return net.ErrClosed
+	}
+	l.conn, l.addr = bc.Conn, bc.bindAddr
+	return nil
+}
+
+// renew sends a new BIND request in the background. A failure is returned by the next Accept.
+func (l *listener) renew() {
+	done := make(chan struct{})
+	l.mu.Lock()
+	l.renewing = done
+	l.mu.Unlock()
+	go func() {
+		defer close(done)
+		if err := l.bind(l.ctx); err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+		}
+	}()
 }
 
 // Accept waits for and returns the next connection to the listener.
+// The proxy is then asked to listen again, and Addr reports the new address once it replied.
 func (l *listener) Accept() (net.Conn, error) {
-	conn, err := l.d.do(l.ctx, BindCommand, l.address)
+	l.acceptMu.Lock()
+	defer l.acceptMu.Unlock()
+
+	l.mu.Lock()
+	renewing := l.renewing
+	l.mu.Unlock()
+	if renewing != nil {
+		<-renewing
+	}
+
+	l.mu.Lock()
+	closed, conn, err := l.closed, l.conn, l.err
+	l.renewing, l.err = nil, nil
+	l.mu.Unlock()
+	if closed {
+		return nil, net.ErrClosed
+	}
 	if err != nil {
+		// The BIND request could not be renewed, the next Accept retries
 		return nil, err
 	}
+	if conn == nil {
+		if err := l.bind(l.ctx); err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		conn = l.conn
+		l.mu.Unlock()
+		if conn == nil {
+			return nil, net.ErrClosed
+		}
+	}
+
 	addr, err := l.d.readReply(conn)
+
+	l.mu.Lock()
+	if l.conn == conn {
+		l.conn = nil
+	}
+	closed = l.closed
+	l.mu.Unlock()
+	if closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+
+	// Renew the BIND request for the next connection
+	l.renew()
 	return &connect{Conn: conn, remoteAddr: addr}, nil
 }
 
-// Close closes the listener.
+// Close closes the listener. The pending BIND request is canceled by closing its control connection.
 func (l *listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	conn := l.conn
+	l.conn = nil
+	l.mu.Unlock()
+	l.cancel()
+	if conn != nil {
+		return conn.Close()
+	}
 	return nil
 }
 
-// address returns the listener's network address.
+// Addr returns the address the proxy listens on for the next connection.
 func (l *listener) Addr() net.Addr {
-	return nil
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.addr
 }
 
 type connect struct {
@@ -3,21 +3,38 @@ package socks5
 import (
 	"bytes"
 	"errors"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 var (
 	errBadHeader         = errors.New("bad header")
 	errUnsupportedMethod = errors.New("unsupported method")
+	errNoTarget          = errors.New("no default target")
 )
 
+// UDPConn is a UDP association of a SOCKS5 proxy server.
+// It is a net.PacketConn that sends to and receives from any destination through the proxy,
+// and a net.Conn for its default target, if any.
+// Destinations are given as net.Addr whose String method returns "host:port",
+// where host may be a domain name that the proxy server resolves.
 type UDPConn struct {
+	// FragmentSize is the maximum payload of a datagram sent to the proxy server,
+	// larger payloads are fragmented. Zero disables fragmentation
+	FragmentSize int
+
 	bufRead       [maxUdpPacket]byte
 	bufWrite      [maxUdpPacket]byte
 	proxyAddress  net.Addr
 	defaultTarget net.Addr
 	prefix        []byte
+	reasm         *reassembler
+	readMu        sync.Mutex
+	writeMu       sync.Mutex
+	control       io.Closer // Control connection of the association, nil if unknown
+	closeOnce     sync.Once
 	net.PacketConn
 }
 
@@ -27,66 +44,125 @@ func NewUDPConn(raw net.PacketConn, proxyAddress net.Addr, defaultTarget net.Add
 		proxyAddress:  proxyAddress,
 		defaultTarget: defaultTarget,
 		prefix:        []byte{0, 0, 0},
+		reasm:         newReassembler(0, 0),
 	}
 	return conn, nil
 }
 
 // ReadFrom implements the net.PacketConn ReadFrom method.
+// Fragmented datagrams are reassembled before they are returned. The address is a *net.UDPAddr,
+// unless the proxy server reports a domain name. Datagrams that do not come from the proxy
+// server or have a bad header are dropped.
 func (c *UDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = c.PacketConn.ReadFrom(c.bufRead[:])
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(c.bufRead[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < len(c.prefix) || addr.String() != c.proxyAddress.String() {
+			continue
+		}
+		frag := c.bufRead[len(c.prefix)-1]
+		buf := bytes.NewBuffer(c.bufRead[len(c.prefix):n])
+		a, err := readAddr(buf)
+		if err != nil {
+			continue
+		}
+		if frag == 0 {
+			c.reasm.reset()
+			n = copy(p, buf.Bytes())
+			return n, udpAddr(a), nil
+		}
+		if data, done := c.reasm.add(frag, a.String(), buf.Bytes()); done {
+			n = copy(p, data)
+			return n, udpAddr(a), nil
+		}
+	}
+}
+
+// udpAddr returns a as a *net.UDPAddr if it has an IP.
+func udpAddr(a *address) net.Addr {
+	if a.IP != nil {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	}
+	return a
+}
+
+// udpTarget parses the address of a destination, which may have a domain name.
+func udpTarget(addr string) (net.Addr, error) {
+	host, port, err := splitHostPort(addr)
 	if err != nil {
-		return 0, nil, err
-	}
-	if n < len(c.prefix) || addr.String() != c.proxyAddress.String() {
-		return 0, nil, errBadHeader
+		return nil, err
 	}
-	buf := bytes.NewBuffer(c.bufRead[len(c.prefix):n])
-	a, err := readAddr(buf)
-	if err != nil {
-		return 0, nil, err
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
 	}
-	n = copy(p, buf.Bytes())
-	return n, a, nil
+	return &address{Name: host, Port: port}, nil
 }
 
 // WriteTo implements the net.PacketConn WriteTo method.
+// Payloads larger than FragmentSize are sent as fragments.
 func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	buf := bytes.NewBuffer(c.bufWrite[:0])
-	buf.Write(c.prefix)
-	err = writeAddrWithStr(buf, addr.String())
-	if err != nil {
-		return 0, err
-	}
-	n, err = buf.Write(p)
+	parts, frags, err := fragmentPayload(p, c.FragmentSize)
 	if err != nil {
 		return 0, err
 	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	for i, part := range parts {
+		buf := bytes.NewBuffer(c.bufWrite[:0])
+		buf.Write(c.prefix[:len(c.prefix)-1])
+		buf.WriteByte(frags[i])
+		err = writeAddrWithStr(buf, addr.String())
+		if err != nil {
+			return 0, err
+		}
+		buf.Write(part)
 
-	data := buf.Bytes()
-	_, err = c.PacketConn.WriteTo(data, c.proxyAddress)
-	if err != nil {
-		return 0, err
+		data := buf.Bytes()
+		_, err = c.PacketConn.WriteTo(data, c.proxyAddress)
+		if err != nil {
+			return 0, err
+		}
 	}
-	return n, nil
+	return len(p), nil
 }
 
 // Read implements the net.Conn Read method.
+// Datagrams from other addresses than the default target are dropped.
 func (c *UDPConn) Read(b []byte) (int, error) {
-	n, addr, err := c.ReadFrom(b)
-	if err != nil {
-		return 0, err
-	}
-	if addr.String() != c.defaultTarget.String() {
-		return c.Read(b)
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if c.defaultTarget == nil || addr.String() == c.defaultTarget.String() {
+			return n, nil
+		}
 	}
-	return n, nil
 }
 
 // Write implements the net.Conn Write method.
 func (c *UDPConn) Write(b []byte) (int, error) {
+	if c.defaultTarget == nil {
+		return 0, errNoTarget
+	}
 	return c.WriteTo(b, c.defaultTarget)
 }
 
+// Close closes the association, including its control connection.
+func (c *UDPConn) Close() error {
+	err := c.PacketConn.Close()
+	c.closeOnce.Do(func() {
+		if c.control != nil {
+			c.control.Close()
+		}
+	})
+	return err
+}
+
 // RemoteAddr implements the net.Conn RemoteAddr method.
 func (c *UDPConn) RemoteAddr() net.Addr {
 	return c.defaultTarget
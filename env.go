@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"os"
+	"strings"
+)
+
+// NoProxy matches the destinations that are dialed directly instead of through the proxy server.
+// It follows the NO_PROXY conventions of curl, see ParseNoProxy. A nil NoProxy matches nothing.
+type NoProxy struct {
+	patterns []*addrPattern
+}
+
+// ParseNoProxy parses a NO_PROXY list. Entries are separated by commas or whitespace and are one of
+//   - "*", matching all destinations,
+//   - a domain name, matching the domain and all its subdomains; a leading "." or "*." is ignored,
+//   - an IP address or a CIDR, e.g. "10.0.0.0/8",
+//
+// each optionally followed by ":port" to match only that port. Names are matched case-insensitively
+// and without resolving them. Invalid entries are ignored, like curl does.
+func ParseNoProxy(s string) *NoProxy {
+	n := &NoProxy{}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' }) {
+		p, err := parseAddrPattern(entry)
+		if err != nil {
+			continue
+		}
+		if p.suffix != "" {
+			p.domain, p.suffix = p.suffix[1:], ""
+		}
+		p.domain = strings.TrimSuffix(p.domain, ".")
+		if p.domain != "" {
+			// A domain also matches its subdomains
+			sub := *p
+			sub.domain, sub.suffix = "", "."+p.domain
+			n.patterns = append(n.patterns, &sub)
+		}
+		n.patterns = append(n.patterns, p)
+	}
+	return n
+}
+
+// Match reports whether the destination address, in the form "host:port" or "host", is bypassed.
+func (n *NoProxy) Match(address string) bool {
+	if n == nil {
+		return false
+	}
+	return matchAddress(n.patterns, address)
+}
+
+// proxyEnv and noProxyEnv are the environment variables read by NewDialerFromEnvironment in order of precedence.
+var (
+	proxyEnv   = []string{"socks5_proxy", "SOCKS5_PROXY", "all_proxy", "ALL_PROXY"}
+	noProxyEnv = []string{"no_proxy", "NO_PROXY"}
+)
+
+// NewDialerFromEnvironment returns a Dialer configured like curl from the environment.
+// The proxy URL is read from socks5_proxy, SOCKS5_PROXY, all_proxy or ALL_PROXY, the first one set wins.
+// A URL without a scheme is treated as socks5h, other schemes than socks5 and socks5h are rejected.
+// The bypass list is read from no_proxy or NO_PROXY, see ParseNoProxy.
+// If no proxy is configured, the Dialer dials all destinations directly.
+func NewDialerFromEnvironment() (*Dialer, error) {
+	proxyURL := getEnvAny(proxyEnv)
+	if proxyURL == "" {
+		return &Dialer{ProxyNetwork: "tcp", NoProxy: ParseNoProxy("*")}, nil
+	}
+	if !strings.Contains(proxyURL, "://") {
+		proxyURL = "socks5h://" + proxyURL
+	}
+	d, err := NewDialer(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	d.NoProxy = ParseNoProxy(getEnvAny(noProxyEnv))
+	return d, nil
+}
+
+// getEnvAny returns the value of the first non-empty environment variable of names.
+func getEnvAny(names []string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
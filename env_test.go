@@ -0,0 +1,90 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestNoProxy_Match(t *testing.T) {
+	n := ParseNoProxy("example.com, .corp.test,*.svc.local ,10.0.0.0/8 192.168.1.1\t[::1],internal.test:8080,bad:port:x")
+	cases := []struct {
+		addr  string
+		match bool
+	}{
+		{"example.com:443", true},
+		{"EXAMPLE.com.:443", true},
+		{"www.example.com:80", true},
+		{"notexample.com:80", false},
+		{"corp.test:80", true},
+		{"a.b.corp.test:80", true},
+		{"svc.local:53", true},
+		{"x.svc.local:53", true},
+		{"10.1.2.3:22", true},
+		{"11.1.2.3:22", false},
+		{"192.168.1.1:80", true},
+		{"192.168.1.2:80", false},
+		{"[::1]:80", true},
+		{"internal.test:8080", true},
+		{"api.internal.test:8080", true},
+		{"internal.test:443", false},
+		{"example.com", true},
+		{"other.test:80", false},
+	}
+	for _, c := range cases {
+		if m := n.Match(c.addr); m != c.match {
+			t.Errorf("%v: expect %v, got %v", c.addr, c.match, m)
+		}
+	}
+
+	if !ParseNoProxy("*").Match("anything.test:1") {
+		t.Fatalf("expect * to match everything")
+	}
+	if ParseNoProxy("").Match("example.com:80") || (*NoProxy)(nil).Match("example.com:80") {
+		t.Fatalf("expect empty list to match nothing")
+	}
+}
+
+func TestNewDialerFromEnvironment(t *testing.T) {
+	for _, name := range append(append([]string{}, proxyEnv...), noProxyEnv...) {
+		t.Setenv(name, "")
+	}
+
+	// Without a proxy everything is dialed directly
+	d, err := NewDialerFromEnvironment()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	echo := startTCPEcho(t)
+	conn, err := d.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	t.Setenv("ALL_PROXY", "http://proxy.test:3128")
+	if _, err := NewDialerFromEnvironment(); err == nil {
+		t.Fatalf("expect http proxy to be rejected")
+	}
+
+	// SOCKS5_PROXY takes precedence, a URL without scheme is socks5h
+	t.Setenv("SOCKS5_PROXY", "user:pass@proxy.test")
+	t.Setenv("no_proxy", "localhost,127.0.0.0/8")
+	d, err = NewDialerFromEnvironment()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d.ProxyAddress != "proxy.test:1080" || d.IsResolve || d.Username != "user" || d.Password != "pass" {
+		t.Fatalf("bad dialer: %+v", d)
+	}
+
+	// Bypassed destinations do not need the proxy server
+	conn, err = d.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("expect a direct connection, got %T", conn)
+	}
+}
@@ -0,0 +1,224 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultEphemeralPurgeInterval is the purge interval of EphemeralCredentials if none is configured.
+	defaultEphemeralPurgeInterval = time.Minute
+)
+
+var (
+	// errCredentialExpired is returned for ephemeral credentials past their expiry.
+	errCredentialExpired = fmt.Errorf("credential expired: %w", errUserAuthFailed)
+)
+
+// EphemeralOptions describes a credential to issue with EphemeralCredentials.
+type EphemeralOptions struct {
+	// TTL is how long the credential can be used to authenticate. It must be positive.
+	TTL time.Duration
+
+	// Uses is the number of times the credential can be used to authenticate.
+	// Zero means the credential can be used until it expires.
+	Uses int
+
+	// Destinations optionally restricts the destinations of sessions authenticated with the credential.
+	// The patterns are those accepted by PermitDestinations.
+	Destinations []string
+}
+
+// EphemeralCredential is a credential issued by EphemeralCredentials.
+type EphemeralCredential struct {
+	// Username is the generated user name.
+	Username string
+
+	// Password is the generated password.
+	Password string
+
+	// Expires is the time the credential can no longer be used.
+	Expires time.Time
+}
+
+// ephemeralEntry is the state of an issued credential.
+type ephemeralEntry struct {
+	password string
+	expires  time.Time
+	uses     int     // Remaining uses, 0 if unlimited
+	rules    RuleSet // Destination rules, can be nil
+}
+
+// EphemeralCredentials is an implementation of the CredentialStore and CredentialVerifier interfaces
+// holding credentials issued programmatically at runtime. Each credential has a TTL, an optional
+// number of uses and an optional set of destinations, for example "one connection to db.internal:5432
+// within 5 minutes". Credentials can be revoked at any time.
+//
+// Expired and spent credentials are purged by a background goroutine, which is stopped by Close.
+type EphemeralCredentials struct {
+	mu        sync.Mutex
+	entries   map[string]*ephemeralEntry
+	listeners revokeListeners
+	done      chan struct{}
+	once      sync.Once
+}
+
+// NewEphemeralCredentials creates an empty EphemeralCredentials that purges expired credentials
+// every purgeInterval. A purgeInterval of zero uses a default of one minute.
+func NewEphemeralCredentials(purgeInterval time.Duration) *EphemeralCredentials {
+	if purgeInterval <= 0 {
+		purgeInterval = defaultEphemeralPurgeInterval
+	}
+	e := &EphemeralCredentials{
+		entries: make(map[string]*ephemeralEntry),
+		done:    make(chan struct{}),
+	}
+	go e.purgeLoop(purgeInterval)
+	return e
+}
+
+// Issue generates a new credential according to opts.
+func (e *EphemeralCredentials) Issue(opts EphemeralOptions) (*EphemeralCredential, error) {
+	if opts.TTL <= 0 {
+		return nil, fmt.Errorf("invalid TTL %v", opts.TTL)
+	}
+	if opts.Uses < 0 {
+		return nil, fmt.Errorf("invalid number of uses %v", opts.Uses)
+	}
+	entry := &ephemeralEntry{
+		expires: time.Now().Add(opts.TTL),
+		uses:    opts.Uses,
+	}
+	if opts.Destinations != nil {
+		rules, err := PermitDestinations(opts.Destinations...)
+		if err != nil {
+			return nil, err
+		}
+		entry.rules = rules
+	}
+
+	password, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	entry.password = password
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var username string
+	for {
+		if username, err = randomHex(8); err != nil {
+			return nil, err
+		}
+		username = "eph-" + username
+		if _, found := e.entries[username]; !found {
+			break
+		}
+	}
+	e.entries[username] = entry
+	return &EphemeralCredential{Username: username, Password: password, Expires: entry.expires}, nil
+}
+
+// Revoke removes the credential of username, so it can no longer be used, and terminates
+// the active sessions authenticated with it. It returns false if no such credential exists.
+func (e *EphemeralCredentials) Revoke(username string) bool {
+	e.mu.Lock()
+	_, found := e.entries[username]
+	delete(e.entries, username)
+	e.mu.Unlock()
+	e.listeners.notify(username, ReasonRevoked)
+	return found
+}
+
+// OnRevoke registers a function which is called with every revoked user, and returns a function
+// which unregisters it. Servers register themselves when they are created and unregister on Close.
+func (e *EphemeralCredentials) OnRevoke(fn func(user, reason string)) (unregister func()) {
+	return e.listeners.add(fn)
+}
+
+// Len returns the number of credentials that have not been purged yet.
+func (e *EphemeralCredentials) Len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.entries)
+}
+
+// Purge removes all expired credentials and returns the number of credentials removed.
+// It is called periodically by the background goroutine.
+func (e *EphemeralCredentials) Purge() int {
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n := 0
+	for username, entry := range e.entries {
+		if !now.Before(entry.expires) {
+			delete(e.entries, username)
+			n++
+		}
+	}
+	return n
+}
+
+// Close stops the background goroutine. Issued credentials remain usable until they expire,
+// but are no longer purged automatically.
+func (e *EphemeralCredentials) Close() error {
+	e.once.Do(func() { close(e.done) })
+	return nil
+}
+
+// Valid checks if the given user and password combination is valid and consumes one use of the credential.
+// It is equivalent to VerifyCredentials without connection metadata.
+func (e *EphemeralCredentials) Valid(user, password string) bool {
+	_, err := e.VerifyCredentials(context.Background(), nil, user, password)
+	return err == nil
+}
+
+// VerifyCredentials checks the user and password and consumes one use of the credential.
+// Spent credentials are removed immediately. The destinations of the credential become the rules of the session.
+func (e *EphemeralCredentials) VerifyCredentials(ctx context.Context, meta *ConnMetadata, user, password string) (*AuthContext, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	entry, found := e.entries[user]
+	if !found || subtle.ConstantTimeCompare([]byte(entry.password), []byte(password)) != 1 {
+		return nil, errUserAuthFailed
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(e.entries, user)
+		return nil, errCredentialExpired
+	}
+	if entry.uses > 0 {
+		entry.uses--
+		if entry.uses == 0 {
+			delete(e.entries, user)
+		}
+	}
+	return &AuthContext{Method: UserPassAuth, Rules: entry.rules}, nil
+}
+
+// purgeLoop purges expired credentials every interval until Close is called.
+func (e *EphemeralCredentials) purgeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Purge()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// randomHex returns n random bytes encoded as hex.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
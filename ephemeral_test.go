@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEphemeralCredentials(t *testing.T) {
+	creds := NewEphemeralCredentials(10 * time.Millisecond)
+	defer creds.Close()
+
+	once, err := creds.Issue(EphemeralOptions{TTL: time.Minute, Uses: 1, Destinations: []string{"db.internal:5432"}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, err := creds.VerifyCredentials(context.Background(), nil, once.Username, once.Password)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := ctx.Rules.Allow(context.Background(), &Request{DestAddr: &AddrSpec{FQDN: "db.internal", Port: 5432}}); !ok {
+		t.Fatalf("expect db.internal allowed")
+	}
+	if _, ok := ctx.Rules.Allow(context.Background(), &Request{DestAddr: &AddrSpec{FQDN: "db.internal", Port: 22}}); ok {
+		t.Fatalf("do not expect port 22 allowed")
+	}
+	if creds.Valid(once.Username, once.Password) {
+		t.Fatalf("expect spent credential")
+	}
+
+	unlimited, _ := creds.Issue(EphemeralOptions{TTL: time.Minute})
+	if !creds.Valid(unlimited.Username, unlimited.Password) || !creds.Valid(unlimited.Username, unlimited.Password) {
+		t.Fatalf("expect valid")
+	}
+	if creds.Valid(unlimited.Username, "wrong") {
+		t.Fatalf("expect invalid password")
+	}
+	if !creds.Revoke(unlimited.Username) || creds.Valid(unlimited.Username, unlimited.Password) {
+		t.Fatalf("expect revoked")
+	}
+
+	// Expired credentials are purged in the background
+	creds.Issue(EphemeralOptions{TTL: 20 * time.Millisecond})
+	if creds.Len() != 1 {
+		t.Fatalf("expect one credential")
+	}
+	deadline := time.Now().Add(time.Second)
+	for creds.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect expired credential to be purged")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := creds.Issue(EphemeralOptions{}); err == nil {
+		t.Fatalf("expect error for missing TTL")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package socks5
+
+import "syscall"
+
+// Error numbers of failed dials mapped to reply codes, see errToReply.
+const (
+	errnoConnRefused = syscall.ECONNREFUSED
+	errnoNetUnreach  = syscall.ENETUNREACH
+	errnoHostUnreach = syscall.EHOSTUNREACH
+)
@@ -0,0 +1,14 @@
+//go:build windows
+
+package socks5
+
+import "syscall"
+
+// Error numbers of failed dials mapped to reply codes, see errToReply.
+// The syscall package only defines invented values for the POSIX names on Windows,
+// dials fail with the Winsock error numbers.
+const (
+	errnoConnRefused = syscall.Errno(10061) // WSAECONNREFUSED
+	errnoNetUnreach  = syscall.Errno(10051) // WSAENETUNREACH
+	errnoHostUnreach = syscall.Errno(10065) // WSAEHOSTUNREACH
+)
@@ -0,0 +1,28 @@
+//go:build windows
+
+package socks5
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrToReply_Winsock(t *testing.T) {
+	for errno, code := range map[syscall.Errno]uint8{
+		10061: connectionRefused,
+		10051: networkUnreachable,
+		10065: hostUnreachable,
+	} {
+		err := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connectex", errno)}
+		if reply := errToReply(err); reply != code {
+			t.Errorf("%v: expect %v, got %v", errno, Reply2String(code), Reply2String(reply))
+		}
+	}
+
+	// The POSIX names are invented values on Windows that dials never fail with
+	if errnoConnRefused == syscall.ECONNREFUSED {
+		t.Fatalf("expect Winsock error number")
+	}
+}
@@ -0,0 +1,131 @@
+package socks5
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// fragEnd is the high-order bit of the FRAG field marking the last fragment of a sequence.
+	fragEnd = byte(0x80)
+
+	// maxFragments is the highest fragment position of a sequence.
+	maxFragments = 127
+
+	// minReassemblyTimeout is the minimum reassembly timer mandated by RFC 1928 section 7.
+	minReassemblyTimeout = 5 * time.Second
+
+	// defaultReassemblyLimit is the default maximum size of a reassembled datagram.
+	defaultReassemblyLimit = 65535
+)
+
+// reassembler is the reassembly queue of fragmented SOCKS5 UDP datagrams, see RFC 1928 section 7.
+//
+// The queue is abandoned when the reassembly timer expires, when a fragment arrives whose position is not
+// the next one of the sequence, e.g. because fragments were lost or reordered, when a fragment for another
+// destination arrives, or when the reassembled datagram would exceed the memory limit.
+// A standalone datagram also abandons the queue, see reset.
+type reassembler struct {
+	mu      sync.Mutex
+	timeout time.Duration // Reassembly timer, at least minReassemblyTimeout
+	limit   int           // Maximum size of a reassembled datagram
+	dst     string        // Destination of the current sequence
+	highest byte          // Highest fragment position processed, 0 if the queue is empty
+	data    []byte        // Reassembled payload so far
+	started time.Time     // Arrival of the first fragment of the sequence
+}
+
+// newReassembler creates a reassembly queue. Non-positive values select the defaults,
+// and the timeout is raised to the minimum of the RFC.
+func newReassembler(timeout time.Duration, limit int) *reassembler {
+	if timeout < minReassemblyTimeout {
+		timeout = minReassemblyTimeout
+	}
+	if limit <= 0 {
+		limit = defaultReassemblyLimit
+	}
+	return &reassembler{timeout: timeout, limit: limit}
+}
+
+// add queues a fragment with the given FRAG field for the destination dst.
+// It returns the reassembled payload and true once the last fragment of the sequence arrived.
+// data is copied, so the caller may reuse it.
+func (r *reassembler) add(frag byte, dst string, data []byte) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pos := frag &^ fragEnd
+	if pos == 0 {
+		// Not a fragment position
+		r.resetLocked()
+		return nil, false
+	}
+	if r.highest != 0 && time.Since(r.started) > r.timeout {
+		r.resetLocked()
+	}
+	if r.highest != 0 && (pos != r.highest+1 || dst != r.dst) {
+		// Out of order, lost or foreign fragment, abandon the sequence
+		r.resetLocked()
+	}
+	if r.highest == 0 {
+		if pos != 1 {
+			// A sequence must start with the first fragment
+			return nil, false
+		}
+		r.dst = dst
+		r.started = time.Now()
+	}
+	if len(r.data)+len(data) > r.limit {
+		r.resetLocked()
+		return nil, false
+	}
+
+	r.data = append(r.data, data...)
+	r.highest = pos
+	if frag&fragEnd == 0 {
+		return nil, false
+	}
+	payload := r.data
+	r.data = nil
+	r.resetLocked()
+	return payload, true
+}
+
+// reset abandons the queue. It is called for every standalone datagram.
+func (r *reassembler) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resetLocked()
+}
+
+// resetLocked abandons the queue, r.mu must be held.
+func (r *reassembler) resetLocked() {
+	r.dst = ""
+	r.highest = 0
+	r.data = r.data[:0]
+}
+
+// fragmentPayload splits data into payloads of at most size bytes and returns them with their FRAG fields.
+// A payload of at most size bytes is returned as a single standalone datagram.
+func fragmentPayload(data []byte, size int) ([][]byte, []byte, error) {
+	if size <= 0 || len(data) <= size {
+		return [][]byte{data}, []byte{0}, nil
+	}
+	n := (len(data) + size - 1) / size
+	if n > maxFragments {
+		return nil, nil, fmt.Errorf("datagram of %v bytes needs more than %v fragments of %v bytes", len(data), maxFragments, size)
+	}
+	parts := make([][]byte, 0, n)
+	frags := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		parts = append(parts, data[i*size:end])
+		frags = append(frags, byte(i+1))
+	}
+	frags[n-1] |= fragEnd
+	return parts, frags, nil
+}
@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReassembler(t *testing.T) {
+	r := newReassembler(0, 0)
+	if r.timeout != minReassemblyTimeout {
+		t.Fatalf("bad timeout: %v", r.timeout)
+	}
+
+	if _, done := r.add(1, "a:1", []byte("foo")); done {
+		t.Fatalf("unexpected completion")
+	}
+	if _, done := r.add(2, "a:1", []byte("bar")); done {
+		t.Fatalf("unexpected completion")
+	}
+	payload, done := r.add(3|fragEnd, "a:1", []byte("baz"))
+	if !done || string(payload) != "foobarbaz" {
+		t.Fatalf("bad payload: %q %v", payload, done)
+	}
+
+	// A single fragment with the end flag is a complete sequence
+	payload, done = r.add(1|fragEnd, "a:1", []byte("foo"))
+	if !done || string(payload) != "foo" {
+		t.Fatalf("bad payload: %q %v", payload, done)
+	}
+}
+
+func TestReassembler_Abort(t *testing.T) {
+	r := newReassembler(0, 0)
+
+	// Out of order
+	r.add(1, "a:1", []byte("foo"))
+	r.add(3, "a:1", []byte("baz"))
+	if _, done := r.add(2|fragEnd, "a:1", []byte("bar")); done {
+		t.Fatalf("out of order sequence completed")
+	}
+
+	// A lower position restarts with the first fragment
+	r.add(1, "a:1", []byte("foo"))
+	r.add(2, "a:1", []byte("bar"))
+	r.add(1, "a:1", []byte("new"))
+	if payload, done := r.add(2|fragEnd, "a:1", []byte("seq")); !done || string(payload) != "newseq" {
+		t.Fatalf("bad payload: %q %v", payload, done)
+	}
+
+	// Another destination
+	r.add(1, "a:1", []byte("foo"))
+	if _, done := r.add(2|fragEnd, "b:1", []byte("bar")); done {
+		t.Fatalf("sequence of two destinations completed")
+	}
+
+	// A standalone datagram
+	r.add(1, "a:1", []byte("foo"))
+	r.reset()
+	if _, done := r.add(2|fragEnd, "a:1", []byte("bar")); done {
+		t.Fatalf("sequence completed after reset")
+	}
+
+	// Expired timer
+	r.add(1, "a:1", []byte("foo"))
+	r.started = time.Now().Add(-2 * minReassemblyTimeout)
+	if _, done := r.add(2|fragEnd, "a:1", []byte("bar")); done {
+		t.Fatalf("expired sequence completed")
+	}
+}
+
+func TestReassembler_Limit(t *testing.T) {
+	r := newReassembler(0, 5)
+	r.add(1, "a:1", []byte("foo"))
+	if _, done := r.add(2|fragEnd, "a:1", []byte("bar")); done {
+		t.Fatalf("sequence above the limit completed")
+	}
+	if len(r.data) != 0 || r.highest != 0 {
+		t.Fatalf("queue not abandoned")
+	}
+}
+
+func TestFragmentPayload(t *testing.T) {
+	parts, frags, err := fragmentPayload([]byte("foobarba"), 3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(parts) != 3 || string(bytes.Join(parts, nil)) != "foobarba" {
+		t.Fatalf("bad parts: %q", parts)
+	}
+	if !bytes.Equal(frags, []byte{1, 2, 3 | fragEnd}) {
+		t.Fatalf("bad frags: %v", frags)
+	}
+
+	parts, frags, _ = fragmentPayload([]byte("foo"), 3)
+	if len(parts) != 1 || frags[0] != 0 {
+		t.Fatalf("small payload fragmented: %q %v", parts, frags)
+	}
+
+	if _, _, err := fragmentPayload(make([]byte, 128), 1); err == nil {
+		t.Fatalf("expected error for too many fragments")
+	}
+}
+
+func TestSOCKS5_Associate_Fragments(t *testing.T) {
+	echo := startUDPEcho(t, "echo: ")
+	defer echo.Close()
+
+	_, server := startServer(t, "tcp", "127.0.0.1:0", &Config{UDPFragmentSize: 4})
+	ctrl, relay := associate(t, server, "0.0.0.0:0")
+	defer ctrl.Close()
+
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := NewUDPConn(raw, relay, echo.LocalAddr())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.FragmentSize = 3
+
+	if _, err := conn.Write([]byte("hello world")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [64]byte
+	n, err := conn.Read(buf[:])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf[:n]) != "echo: hello world" {
+		t.Fatalf("bad: %q", buf[:n])
+	}
+}
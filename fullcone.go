@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxFullConeRemotes is the number of inbound rule decisions cached by a full-cone relay.
+	maxFullConeRemotes = 1024
+)
+
+// fullConeRelay is the outbound socket of a UDP association in full-cone mode, see Config.UDPFullCone.
+// All destinations of the association share one unconnected socket, so datagrams from any
+// remote reach the client, as long as the rules of the association permit the remote.
+type fullConeRelay struct {
+	pc        net.PacketConn
+	s         *Server
+	req       *Request
+	source    *udpSourceFilter
+	peers     *UdpAssociate
+	udpServer *UdpServer
+
+	mu      sync.Mutex
+	dsts    map[string]*UdpPeer // Destinations of the client by real address
+	remotes map[string]bool     // Rule decisions for other remotes
+}
+
+// listenFullCone opens the outbound socket of an association.
+// The socket faces the destinations, so it is not bound like the relay socket facing the client,
+// see Config.ListenIP and Config.ListenPorts.
+func listenFullCone(s *Server, req *Request, source *udpSourceFilter, peers *UdpAssociate, udpServer *UdpServer) (*fullConeRelay, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return &fullConeRelay{
+		pc:        pc,
+		s:         s,
+		req:       req,
+		source:    source,
+		peers:     peers,
+		udpServer: udpServer,
+		dsts:      make(map[string]*UdpPeer),
+		remotes:   make(map[string]bool),
+	}, nil
+}
+
+// conn returns the connection of a destination, which writes to it through the shared socket.
+func (r *fullConeRelay) conn(peer *UdpPeer, addr *net.UDPAddr) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dsts[addr.String()] = peer
+	return &fullConeConn{relay: r, peer: peer, addr: addr}
+}
+
+// forget removes a destination, e.g. because it expired.
+func (r *fullConeRelay) forget(peer *UdpPeer, addr *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dsts[addr.String()] == peer {
+		delete(r.dsts, addr.String())
+	}
+}
+
+// destination returns the destination of the client with the given address, or nil if there is none.
+func (r *fullConeRelay) destination(addr *net.UDPAddr) *UdpPeer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dsts[addr.String()]
+}
+
+// allowRemote reports whether datagrams from a remote that is not a destination of the client
+// may be relayed to the client. The remote is checked like a destination.
+func (r *fullConeRelay) allowRemote(ctx context.Context, addr *net.UDPAddr) bool {
+	key := addr.String()
+	r.mu.Lock()
+	allowed, found := r.remotes[key]
+	r.mu.Unlock()
+	if found {
+		return allowed
+	}
+	remoteReq := &Request{
+		Version:      socks5Version,
+		Command:      AssociateCommand,
+		AuthContext:  r.req.AuthContext,
+		RemoteAddr:   r.req.RemoteAddr,
+		DestAddr:     &AddrSpec{IP: addr.IP, Port: addr.Port},
+		realDestAddr: &AddrSpec{IP: addr.IP, Port: addr.Port},
+		session:      r.req.session,
+		Datagram:     true,
+	}
+	_, allowed = r.s.allow(ctx, remoteReq)
+	r.mu.Lock()
+	if len(r.remotes) >= maxFullConeRemotes {
+		r.remotes = make(map[string]bool)
+	}
+	r.remotes[key] = allowed
+	r.mu.Unlock()
+	return allowed
+}
+
+// serve relays the datagrams received on the shared socket to the client until the socket is closed.
+func (r *fullConeRelay) serve(ctx context.Context, memCreater MemAllocation) {
+	bs := make([]byte, 65536)
+	out := make([]byte, 65536)
+	for {
+		n, addr, err := r.pc.ReadFrom(bs)
+		if err != nil {
+			return
+		}
+		remote, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		client := r.source.addr()
+		if client == nil {
+			// The client has not sent anything yet
+			continue
+		}
+
+		reply := &UdpPeer{
+			udpServer: r.udpServer,
+			from:      *client,
+			req:       r.req,
+			assoc:     r.peers,
+		}
+		if dst := r.destination(remote); dst != nil {
+			// Replies of destinations carry the address the client sent to, e.g. a domain name
+			reply.atyp, reply.dstAddr, reply.dstPort = dst.atyp, dst.dstAddr, dst.dstPort
+			dst.touch()
+		} else {
+			if !r.allowRemote(ctx, remote) {
+				r.s.stats.udpDeniedDropped.Add(1)
+				continue
+			}
+			reply.atyp = ipv4Address
+			reply.dstAddr = remote.IP.To4()
+			if reply.dstAddr == nil {
+				reply.atyp = ipv6Address
+				reply.dstAddr = remote.IP.To16()
+			}
+			reply.dstPort = binary.BigEndian.AppendUint16(nil, uint16(remote.Port))
+		}
+		if err := relayToSrc(ctx, r.s, reply, memCreater, bs[:n], out); err != nil {
+			r.s.config.Logger.Printf("[WARN] socks: Dropped datagram from %v: %v", remote, err)
+		}
+	}
+}
+
+// Close closes the shared socket.
+func (r *fullConeRelay) Close() error {
+	return r.pc.Close()
+}
+
+// fullConeConn is the connection of a destination in full-cone mode.
+// Only Write and Close are used, replies are read by fullConeRelay.serve.
+type fullConeConn struct {
+	relay *fullConeRelay
+	peer  *UdpPeer
+	addr  *net.UDPAddr
+}
+
+func (c *fullConeConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *fullConeConn) Write(b []byte) (int, error) {
+	return c.relay.pc.WriteTo(b, c.addr)
+}
+
+func (c *fullConeConn) Close() error {
+	c.relay.forget(c.peer, c.addr)
+	return nil
+}
+
+func (c *fullConeConn) LocalAddr() net.Addr {
+	return c.relay.pc.LocalAddr()
+}
+
+func (c *fullConeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *fullConeConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *fullConeConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *fullConeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
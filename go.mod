@@ -1,3 +1,5 @@
 module github.com/AI-QL/go-socks5
 
 go 1.23.1
+
+require golang.org/x/net v0.38.0
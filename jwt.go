@@ -0,0 +1,238 @@
+package socks5
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// errTokenMalformed is returned when the password is not a well-formed JSON Web Token.
+	errTokenMalformed = fmt.Errorf("%w: malformed token", errUserAuthFailed)
+
+	// errTokenSignature is returned when no configured key verifies the token signature.
+	errTokenSignature = fmt.Errorf("%w: invalid token signature", errUserAuthFailed)
+)
+
+// JWTKey is a key used to verify the signature of JSON Web Tokens.
+// Exactly one of Secret and PublicKey should be set.
+type JWTKey struct {
+	// ID is matched against the "kid" header of a token.
+	// Tokens without "kid" are verified with every key of the matching algorithm.
+	ID string
+
+	// Secret is the shared secret for tokens signed with HS256.
+	Secret []byte
+
+	// PublicKey is the public key for tokens signed with EdDSA (Ed25519).
+	PublicKey ed25519.PublicKey
+}
+
+// JWTCredentials is an implementation of the CredentialStore and CredentialVerifier interfaces which
+// accepts a signed JSON Web Token in the password field of the user/password authentication.
+//
+// The token must be signed with HS256 or EdDSA by one of the configured keys and must carry an "exp" claim.
+// The "aud", "iss" and "nbf" claims are validated when present or configured. The following claims are
+// mapped into the AuthContext of the session:
+//   - "sub" is stored as "Subject" in the payload,
+//   - "jti" is stored as "TokenID" in the payload,
+//   - "exp" becomes the expiry of the session, which is terminated when the token expires,
+//   - "dst", a list of destination patterns as accepted by PermitDestinations, restricts the
+//     destinations the session may reach.
+type JWTCredentials struct {
+	// Keys are the keys accepted for verifying token signatures.
+	Keys []JWTKey
+
+	// Audience, if not empty, must be contained in the "aud" claim of the token.
+	Audience string
+
+	// Issuer, if not empty, must be equal to the "iss" claim of the token.
+	Issuer string
+
+	// MatchUsername requires the user name sent by the client to be equal to the "sub" claim.
+	// Otherwise the user name is ignored.
+	MatchUsername bool
+
+	// Leeway is the clock skew tolerated when validating "exp" and "nbf".
+	Leeway time.Duration
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the claims of a token the credentials understand.
+type jwtClaims struct {
+	Subject      string      `json:"sub"`
+	Issuer       string      `json:"iss"`
+	Audience     jwtAudience `json:"aud"`
+	ExpiresAt    *float64    `json:"exp"`
+	NotBefore    *float64    `json:"nbf"`
+	ID           string      `json:"jti"`
+	Destinations []string    `json:"dst"`
+}
+
+// jwtAudience is the "aud" claim, which is either a string or a list of strings.
+type jwtAudience []string
+
+// UnmarshalJSON decodes a single audience or a list of audiences.
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Valid checks if the given token is valid.
+// It is equivalent to VerifyCredentials without connection metadata.
+func (j *JWTCredentials) Valid(user, password string) bool {
+	_, err := j.VerifyCredentials(context.Background(), nil, user, password)
+	return err == nil
+}
+
+// VerifyCredentials verifies the token in password and derives the AuthContext of the session from its claims.
+func (j *JWTCredentials) VerifyCredentials(ctx context.Context, meta *ConnMetadata, user, password string) (*AuthContext, error) {
+	claims, err := j.parse(password)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: token has no expiry", errUserAuthFailed)
+	}
+	expires := numericDate(*claims.ExpiresAt)
+	if !now.Before(expires.Add(j.Leeway)) {
+		return nil, fmt.Errorf("%w: token expired at %v", errUserAuthFailed, expires)
+	}
+	if claims.NotBefore != nil {
+		if notBefore := numericDate(*claims.NotBefore); now.Add(j.Leeway).Before(notBefore) {
+			return nil, fmt.Errorf("%w: token not valid before %v", errUserAuthFailed, notBefore)
+		}
+	}
+	if j.Audience != "" && !claims.Audience.contains(j.Audience) {
+		return nil, fmt.Errorf("%w: token audience %v does not contain %q", errUserAuthFailed, []string(claims.Audience), j.Audience)
+	}
+	if j.Issuer != "" && claims.Issuer != j.Issuer {
+		return nil, fmt.Errorf("%w: token issuer %q is not %q", errUserAuthFailed, claims.Issuer, j.Issuer)
+	}
+	if j.MatchUsername && claims.Subject != user {
+		return nil, fmt.Errorf("%w: token subject %q does not match user %q", errUserAuthFailed, claims.Subject, user)
+	}
+
+	authContext := &AuthContext{
+		Method:  UserPassAuth,
+		Payload: map[string]string{},
+		Expires: expires.Add(j.Leeway),
+	}
+	if claims.Subject != "" {
+		authContext.Payload["Subject"] = claims.Subject
+	}
+	if claims.ID != "" {
+		authContext.Payload["TokenID"] = claims.ID
+	}
+	if claims.Destinations != nil {
+		authContext.Rules, err = PermitDestinations(claims.Destinations...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid token destinations: %v", errUserAuthFailed, err)
+		}
+	}
+	return authContext, nil
+}
+
+// parse verifies the signature of the token and decodes its claims.
+func (j *JWTCredentials) parse(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	if !j.verifySignature(&header, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errTokenSignature
+	}
+
+	claims := new(jwtClaims)
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature reports whether one of the keys matching the header verifies the signature.
+// The algorithm of the header selects the kind of key, so a public key is never used as an HMAC secret.
+func (j *JWTCredentials) verifySignature(header *jwtHeader, signed, signature []byte) bool {
+	for _, key := range j.Keys {
+		if header.Kid != "" && key.ID != header.Kid {
+			continue
+		}
+		switch header.Alg {
+		case "HS256":
+			if len(key.Secret) == 0 {
+				continue
+			}
+			mac := hmac.New(sha256.New, key.Secret)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case "EdDSA":
+			if len(key.PublicKey) != ed25519.PublicKeySize {
+				continue
+			}
+			if ed25519.Verify(key.PublicKey, signed, signature) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contains reports whether the audience contains aud.
+func (a jwtAudience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a token.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errTokenMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errTokenMalformed
+	}
+	return nil
+}
+
+// numericDate converts a JWT NumericDate to a time.
+func numericDate(v float64) time.Time {
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*float64(time.Second)))
+}
@@ -0,0 +1,176 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "EdDSA":
+		sig = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTCredentials(t *testing.T) {
+	secret := []byte("secret")
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	creds := &JWTCredentials{
+		Keys:     []JWTKey{{Secret: secret}, {PublicKey: pub}},
+		Audience: "socks",
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	token := signJWT(t, "HS256", secret, map[string]interface{}{
+		"sub": "ci", "aud": "socks", "exp": exp, "jti": "1", "dst": []string{"db.internal:5432"},
+	})
+	ctx, err := creds.VerifyCredentials(context.Background(), nil, "ci", token)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Payload["Subject"] != "ci" || ctx.Payload["TokenID"] != "1" || ctx.Expires.Unix() != exp {
+		t.Fatalf("bad context: %#v", ctx)
+	}
+	if _, ok := ctx.Rules.Allow(context.Background(), &Request{DestAddr: &AddrSpec{FQDN: "db.internal", Port: 5432}}); !ok {
+		t.Fatalf("expect db.internal allowed")
+	}
+	if _, ok := ctx.Rules.Allow(context.Background(), &Request{DestAddr: &AddrSpec{FQDN: "web.internal", Port: 443}}); ok {
+		t.Fatalf("do not expect web.internal allowed")
+	}
+
+	token = signJWT(t, "EdDSA", priv, map[string]interface{}{"sub": "ci", "aud": []string{"other", "socks"}, "exp": exp})
+	if !creds.Valid("ci", token) {
+		t.Fatalf("expect valid EdDSA token")
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"expired":      {"aud": "socks", "exp": time.Now().Add(-time.Minute).Unix()},
+		"no expiry":    {"aud": "socks"},
+		"not before":   {"aud": "socks", "exp": exp, "nbf": time.Now().Add(time.Minute).Unix()},
+		"bad audience": {"aud": "other", "exp": exp},
+	} {
+		if _, err := creds.VerifyCredentials(context.Background(), nil, "ci", signJWT(t, "HS256", secret, claims)); !errors.Is(err, ErrCredentialsRejected) {
+			t.Fatalf("expect invalid token: %v: %v", name, err)
+		}
+	}
+	if creds.Valid("ci", signJWT(t, "HS256", []byte("wrong"), map[string]interface{}{"aud": "socks", "exp": exp})) {
+		t.Fatalf("expect invalid signature")
+	}
+}
+
+func TestJWTCredentials_Rejected(t *testing.T) {
+	secret := []byte("secret")
+	s, _ := New(&Config{Credentials: &JWTCredentials{Keys: []JWTKey{{Secret: secret}}}})
+
+	for _, token := range []string{
+		"not.a.token",
+		signJWT(t, "HS256", secret, map[string]interface{}{"sub": "ci", "exp": time.Now().Add(-time.Minute).Unix()}),
+		signJWT(t, "HS256", []byte("wrong"), map[string]interface{}{"sub": "ci", "exp": time.Now().Add(time.Minute).Unix()}),
+	} {
+		req := bytes.NewBuffer(nil)
+		req.Write([]byte{1, UserPassAuth})
+		req.Write([]byte{1, 2, 'c', 'i', byte(len(token))})
+		req.WriteString(token)
+		var resp bytes.Buffer
+		if _, err := s.authenticate(context.Background(), nil, &resp, req); !errors.Is(err, ErrCredentialsRejected) {
+			t.Fatalf("expect rejection, got %v", err)
+		}
+		if out := resp.Bytes(); !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
+			t.Fatalf("bad: %v", out)
+		}
+	}
+
+	// Bad tokens are rejections, not failures to verify them
+	if n := s.Stats().AuthErrors; n != 0 {
+		t.Fatalf("expect no auth errors, got %v", n)
+	}
+}
+
+func TestJWTCredentials_SessionExpiry(t *testing.T) {
+	// Create a local echo listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Create a socks server accepting tokens
+	secret := []byte("secret")
+	serv, _ := New(&Config{
+		Credentials: &JWTCredentials{Keys: []JWTKey{{Secret: secret}}},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sl.Close()
+	go serv.Serve(sl)
+
+	conn, err := net.Dial("tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	exp := float64(time.Now().Add(300*time.Millisecond).UnixNano()) / float64(time.Second)
+	token := signJWT(t, "HS256", secret, map[string]interface{}{"sub": "ci", "exp": exp})
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, UserPassAuth})
+	req.Write([]byte{1, 2, 'c', 'i', byte(len(token))})
+	req.WriteString(token)
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	req.Write(port)
+	req.Write([]byte("ping"))
+	conn.Write(req.Bytes())
+
+	out := make([]byte, 2+2+10+4)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[3] != authSuccess || out[5] != successReply || !bytes.Equal(out[14:], []byte("ping")) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	// The server closes the connection once the token expires
+	if _, err := conn.Read(out); err != io.EOF {
+		t.Fatalf("expect EOF after expiry, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package socks5
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// String returns the range in the form "first-last".
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// valid reports whether the range is usable.
+func (r PortRange) valid() bool {
+	return r.First > 0 && r.First <= r.Last && r.Last <= 65535
+}
+
+// localAddr returns the local address of the control connection, or nil if it has none,
+// e.g. because the connection is only a writer in tests.
+func localAddr(conn conn) net.Addr {
+	if c, ok := conn.(interface{ LocalAddr() net.Addr }); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+// listenIP returns the IP that BIND and UDP ASSOCIATE requests received on conn listen on.
+// It is Config.ListenIP if set, otherwise the local IP of the control connection,
+// so IPv6 clients get IPv6 addresses. Clients without an IP, e.g. on Unix domain sockets,
+// are local, so they get the loopback address rather than a socket reachable from any network.
+func (s *Server) listenIP(conn conn) net.IP {
+	if s.config.ListenIP != nil {
+		return s.config.ListenIP
+	}
+	if ip := addrIP(localAddr(conn)); ip != nil {
+		return ip
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// listenPorts returns the ports to try in order: 0 if no port range is configured,
+// otherwise the ports of the range, starting at a random one.
+func (s *Server) listenPorts() []int {
+	r := s.config.ListenPorts
+	if !r.valid() {
+		return []int{0}
+	}
+	n := r.Last - r.First + 1
+	start := rand.Intn(n)
+	ports := make([]int, n)
+	for i := range ports {
+		ports[i] = r.First + (start+i)%n
+	}
+	return ports
+}
+
+// listenTCP listens for a BIND request received on conn.
+func (s *Server) listenTCP(conn conn) (net.Listener, error) {
+	ip := s.listenIP(conn)
+	var err error
+	for _, port := range s.listenPorts() {
+		var l net.Listener
+		l, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to listen on %v in %v: %v", ip, s.config.ListenPorts, err)
+}
+
+// listenUDP listens for a UDP ASSOCIATE request received on conn.
+func (s *Server) listenUDP(conn conn) (*net.UDPConn, error) {
+	ip := s.listenIP(conn)
+	var err error
+	for _, port := range s.listenPorts() {
+		var l *net.UDPConn
+		l, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to listen on %v in %v: %v", ip, s.config.ListenPorts, err)
+}
+
+// advertisedAddr returns the address reported to the client for a socket bound to bound
+// for a request received on conn. The host is, in order of preference, Config.AdvertisedAddr,
+// Config.BindIP, the bound IP unless it is unspecified, and the local IP of the control connection.
+func (s *Server) advertisedAddr(conn conn, bound net.Addr) *AddrSpec {
+	spec := &AddrSpec{}
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		spec.Port = a.Port
+	case *net.UDPAddr:
+		spec.Port = a.Port
+	}
+	switch ip := addrIP(bound); {
+	case s.config.AdvertisedAddr != "":
+		if ip := net.ParseIP(s.config.AdvertisedAddr); ip != nil {
+			spec.IP = ip
+		} else {
+			spec.FQDN = s.config.AdvertisedAddr
+		}
+	case s.config.BindIP != nil:
+		spec.IP = s.config.BindIP
+	case ip != nil && !ip.IsUnspecified():
+		spec.IP = ip
+	default:
+		spec.IP = addrIP(localAddr(conn))
+		if spec.IP == nil {
+			spec.IP = net.IPv4zero
+		}
+	}
+	return spec
+}
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func requestBind(t *testing.T, network, server string, cmd uint8) (net.Conn, *address) {
+	conn, err := net.Dial(network, server)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d := &Dialer{}
+	if err := d.connectAuth(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr, err := d.connectCommand(conn, cmd, "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return conn, addr.(*address)
+}
+
+func TestListen_DefaultsToControlAddress(t *testing.T) {
+	_, server := startServer(t, "tcp", "[::1]:0", &Config{})
+	for _, cmd := range []uint8{BindCommand, AssociateCommand} {
+		_, addr := requestBind(t, "tcp", server, cmd)
+		if !addr.IP.Equal(net.IPv6loopback) || addr.Port == 0 {
+			t.Fatalf("expect IPv6 loopback address, got %v", addr)
+		}
+	}
+}
+
+func TestListen_UnixControlDefaultsToLoopback(t *testing.T) {
+	_, server := startServer(t, "unix", filepath.Join(t.TempDir(), "socks.sock"), &Config{})
+	for _, cmd := range []uint8{BindCommand, AssociateCommand} {
+		_, addr := requestBind(t, "unix", server, cmd)
+		if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port == 0 {
+			t.Fatalf("expect loopback address, got %v", addr)
+		}
+	}
+}
+
+func TestListen_PortRange(t *testing.T) {
+	// Find a port that is free for TCP and UDP
+	var port int
+	for i := 0; i < 10 && port == 0; i++ {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		p := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if u, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: p}); err == nil {
+			u.Close()
+			port = p
+		}
+	}
+	if port == 0 {
+		t.Skip("no free port")
+	}
+
+	_, server := startServer(t, "tcp", "127.0.0.1:0", &Config{
+		ListenIP:    net.ParseIP("127.0.0.1"),
+		ListenPorts: PortRange{First: port, Last: port},
+	})
+	for _, cmd := range []uint8{BindCommand, AssociateCommand} {
+		conn, addr := requestBind(t, "tcp", server, cmd)
+		if addr.Port != port {
+			t.Fatalf("expect port %v, got %v", port, addr)
+		}
+		conn.Close()
+	}
+}
+
+func TestListen_InvalidPorts(t *testing.T) {
+	for _, r := range []PortRange{{First: 2000, Last: 1000}, {First: 0, Last: 1000}, {First: 1000, Last: 70000}, {First: -1, Last: 1000}} {
+		if _, err := New(&Config{ListenPorts: r}); err == nil {
+			t.Fatalf("expect port range %v to be rejected", r)
+		}
+	}
+	if _, err := New(&Config{ListenPorts: PortRange{First: 1000, Last: 1000}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestListen_AdvertisedAddr(t *testing.T) {
+	_, server := startServer(t, "tcp", "127.0.0.1:0", &Config{
+		BindIP:         net.ParseIP("127.0.0.2"),
+		AdvertisedAddr: "relay.example.com",
+	})
+	_, addr := requestBind(t, "tcp", server, AssociateCommand)
+	if addr.Name != "relay.example.com" || addr.Port == 0 {
+		t.Fatalf("expect advertised name, got %v", addr)
+	}
+
+	_, server = startServer(t, "tcp", "127.0.0.1:0", &Config{BindIP: net.ParseIP("127.0.0.2")})
+	_, addr = requestBind(t, "tcp", server, BindCommand)
+	if !addr.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("expect BindIP, got %v", addr)
+	}
+}
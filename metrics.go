@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"sync/atomic"
+)
+
+// Stats contains counters describing the activity of a Server.
+type Stats struct {
+	// UDPSpoofedDropped is the number of datagrams dropped because they did not come
+	// from the client of the UDP association.
+	UDPSpoofedDropped uint64
+
+	// UDPDeniedDropped is the number of datagrams dropped because their destination
+	// was denied by the rules.
+	UDPDeniedDropped uint64
+
+	// UDPMalformedDropped is the number of datagrams from clients dropped because
+	// their header could not be parsed.
+	UDPMalformedDropped uint64
+
+	// BindPeersDropped is the number of incoming BIND connections dropped because they did not
+	// come from the destination of the request or were denied by the rules.
+	BindPeersDropped uint64
+
+	// UDPPeers is the number of open destinations of all UDP associations.
+	UDPPeers int
+
+	// UDPPeersExpired is the number of destinations closed because they were idle.
+	UDPPeersExpired uint64
+
+	// UDPPeersEvicted is the number of destinations closed to make room for new ones.
+	UDPPeersEvicted uint64
+
+	// AuthErrors is the number of authentications failed because the credential store
+	// could not verify the credentials, e.g. because its backend was unreachable.
+	AuthErrors uint64
+}
+
+// serverStats holds the counters of a Server. The zero value is ready to use.
+type serverStats struct {
+	udpSpoofedDropped   atomic.Uint64
+	udpDeniedDropped    atomic.Uint64
+	udpMalformedDropped atomic.Uint64
+	udpPeersExpired     atomic.Uint64
+	udpPeersEvicted     atomic.Uint64
+	bindPeersDropped    atomic.Uint64
+	authErrors          atomic.Uint64
+}
+
+// Stats returns a snapshot of the counters of the server.
+func (s *Server) Stats() Stats {
+	return Stats{
+		UDPSpoofedDropped:   s.stats.udpSpoofedDropped.Load(),
+		UDPDeniedDropped:    s.stats.udpDeniedDropped.Load(),
+		UDPMalformedDropped: s.stats.udpMalformedDropped.Load(),
+		BindPeersDropped:    s.stats.bindPeersDropped.Load(),
+		UDPPeers:            s.udpPeers.len(),
+		UDPPeersExpired:     s.stats.udpPeersExpired.Load(),
+		UDPPeersEvicted:     s.stats.udpPeersEvicted.Load(),
+		AuthErrors:          s.stats.authErrors.Load(),
+	}
+}
@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// addrPattern matches destination addresses.
+//
+// A pattern is a host optionally followed by ":port". The host is one of
+//   - "*", matching any host,
+//   - a domain name, matching the name exactly,
+//   - "*.domain" or ".domain", matching all subdomains of domain,
+//   - an IP address,
+//   - a CIDR, e.g. "10.0.0.0/8".
+//
+// The port is a number or "*", a missing port matches any port.
+// IPv6 addresses and networks must be enclosed in square brackets when a port is given,
+// e.g. "[2001:db8::/32]:443".
+type addrPattern struct {
+	any     bool       // Matches any host
+	domain  string     // Exact domain name, lower case
+	suffix  string     // Domain suffix including the leading dot, lower case
+	ip      net.IP     // Exact IP address
+	network *net.IPNet // IP network
+	port    int        // Port, 0 matches any port
+}
+
+// parseAddrPattern parses a destination pattern.
+func parseAddrPattern(s string) (*addrPattern, error) {
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid pattern %q: missing ']'", s)
+		}
+		host, port = s[1:end], s[end+1:]
+		if port != "" {
+			if !strings.HasPrefix(port, ":") {
+				return nil, fmt.Errorf("invalid pattern %q", s)
+			}
+			port = port[1:]
+		}
+	} else if strings.Count(s, ":") == 1 {
+		i := strings.LastIndex(s, ":")
+		host, port = s[:i], s[i+1:]
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid pattern %q: empty host", s)
+	}
+
+	p := &addrPattern{}
+	if port != "" && port != "*" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 0xffff {
+			return nil, fmt.Errorf("invalid pattern %q: bad port %q", s, port)
+		}
+		p.port = n
+	}
+
+	switch {
+	case host == "*":
+		p.any = true
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", s, err)
+		}
+		p.network = network
+	case net.ParseIP(host) != nil:
+		p.ip = net.ParseIP(host)
+	case strings.HasPrefix(host, "*."):
+		p.suffix = strings.ToLower(host[1:])
+	case strings.HasPrefix(host, "."):
+		p.suffix = strings.ToLower(host)
+	default:
+		p.domain = strings.ToLower(host)
+	}
+	return p, nil
+}
+
+// parseAddrPatterns parses a list of destination patterns.
+func parseAddrPatterns(patterns []string) ([]*addrPattern, error) {
+	parsed := make([]*addrPattern, 0, len(patterns))
+	for _, s := range patterns {
+		p, err := parseAddrPattern(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// match reports whether the destination matches the pattern.
+// name is the domain name of the destination and ip its address, either may be empty.
+func (p *addrPattern) match(name string, ip net.IP, port int) bool {
+	if p.port != 0 && p.port != port {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case p.any:
+		return true
+	case p.domain != "":
+		return name == p.domain
+	case p.suffix != "":
+		return strings.HasSuffix(name, p.suffix)
+	case p.ip != nil:
+		return ip != nil && p.ip.Equal(ip)
+	case p.network != nil:
+		return ip != nil && p.network.Contains(ip)
+	}
+	return false
+}
+
+// matchAddrPatterns reports whether the destination matches any of the patterns.
+func matchAddrPatterns(patterns []*addrPattern, name string, ip net.IP, port int) bool {
+	for _, p := range patterns {
+		if p.match(name, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress reports whether a destination address, in the form "host:port" or "host", matches any of the patterns.
+// Domain names are not resolved.
+func matchAddress(patterns []*addrPattern, address string) bool {
+	host, port := address, 0
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	host = strings.Trim(host, "[]")
+	return matchAddrPatterns(patterns, host, net.ParseIP(host), port)
+}
@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+var (
+	_ netproxy.Dialer        = (*Dialer)(nil)
+	_ netproxy.ContextDialer = (*Dialer)(nil)
+)
+
+// FromURL returns a Dialer for a socks5:// or socks5h:// proxy URL, see NewDialer.
+// The proxy server is dialed through forward, unless it is nil or proxy.Direct.
+// It has the signature expected by proxy.RegisterDialerType.
+func FromURL(u *url.URL, forward netproxy.Dialer) (netproxy.Dialer, error) {
+	d, err := fromURL(u, u.Scheme, forward)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// RegisterDialerType registers scheme with proxy.RegisterDialerType, so proxy.FromURL and
+// proxy.FromEnvironment return a Dialer of this package for URLs with that scheme.
+// The URLs are treated like URLs with the scheme base, which is either "socks5" or "socks5h".
+//
+// proxy.FromURL handles the socks5 and socks5h schemes itself, so they cannot be registered.
+// Register another scheme, e.g. "socks5+go", or call FromURL directly.
+func RegisterDialerType(scheme, base string) error {
+	switch scheme {
+	case "socks5", "socks5h":
+		return fmt.Errorf("scheme %q is handled by golang.org/x/net/proxy", scheme)
+	}
+	switch base {
+	case "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported protocol '%s'", base)
+	}
+	netproxy.RegisterDialerType(scheme, func(u *url.URL, forward netproxy.Dialer) (netproxy.Dialer, error) {
+		d, err := fromURL(u, base, forward)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	})
+	return nil
+}
+
+func fromURL(u *url.URL, scheme string, forward netproxy.Dialer) (*Dialer, error) {
+	d, err := newDialerFromURL(u, scheme)
+	if err != nil {
+		return nil, err
+	}
+	if forward != nil && forward != netproxy.Direct {
+		if cd, ok := forward.(netproxy.ContextDialer); ok {
+			d.ProxyDial = cd.DialContext
+		} else {
+			d.ProxyDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialWithContext(ctx, forward, network, address)
+			}
+		}
+	}
+	return d, nil
+}
+
+// dialWithContext dials with a dialer that does not support contexts,
+// returning early when ctx is done.
+func dialWithContext(ctx context.Context, dialer netproxy.Dialer, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial(network, address)
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Transport returns an http.Transport that connects to servers through the proxy server.
+// Its other settings are those of http.DefaultTransport, except that it ignores the proxy
+// environment variables. Dialer.Timeout and the request contexts bound each connection setup.
+//
+// Whether domain names are resolved locally follows Dialer.IsResolve.
+func (d *Dialer) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = d.DialContext
+	return t
+}
+
+// HTTPClient returns an http.Client that sends requests through the proxy server, see Transport.
+func (d *Dialer) HTTPClient() *http.Client {
+	return &http.Client{Transport: d.Transport()}
+}
@@ -0,0 +1,524 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RADIUS packet codes, RFC 2865 and RFC 2866.
+	radiusAccessRequest      = uint8(1)
+	radiusAccessAccept       = uint8(2)
+	radiusAccessReject       = uint8(3)
+	radiusAccountingRequest  = uint8(4)
+	radiusAccountingResponse = uint8(5)
+
+	// RADIUS attribute types.
+	radiusUserName             = uint8(1)
+	radiusUserPassword         = uint8(2)
+	radiusNASIPAddress         = uint8(4)
+	radiusFilterID             = uint8(11)
+	radiusReplyMessage         = uint8(18)
+	radiusClass                = uint8(25)
+	radiusSessionTimeout       = uint8(27)
+	radiusCallingStationID     = uint8(31)
+	radiusNASIdentifier        = uint8(32)
+	radiusAcctStatusType       = uint8(40)
+	radiusAcctInputOctets      = uint8(42)
+	radiusAcctOutputOctets     = uint8(43)
+	radiusAcctSessionID        = uint8(44)
+	radiusAcctSessionTime      = uint8(46)
+	radiusAcctTerminateCause   = uint8(49)
+	radiusAcctInputGigawords   = uint8(52)
+	radiusAcctOutputGigawords  = uint8(53)
+	radiusNASPortType          = uint8(61)
+	radiusMessageAuthenticator = uint8(80)
+
+	// Acct-Status-Type values.
+	radiusAcctStart   = uint32(1)
+	radiusAcctStop    = uint32(2)
+	radiusAcctInterim = uint32(3)
+
+	// Acct-Terminate-Cause values.
+	radiusCauseUserRequest    = uint32(1)
+	radiusCauseAdminReset     = uint32(6)
+	radiusCauseSessionTimeout = uint32(5)
+
+	// radiusNASPortVirtual is the NAS-Port-Type of a virtual connection.
+	radiusNASPortVirtual = uint32(5)
+
+	// radiusHeaderLen is the length of the code, identifier, length and authenticator fields.
+	radiusHeaderLen = 20
+
+	// radiusMaxPacket is the maximum size of a RADIUS packet.
+	radiusMaxPacket = 4096
+
+	// radiusMaxPassword is the maximum length of a password sent as User-Password, see RFC 2865 section 5.2.
+	radiusMaxPassword = 128
+
+	// defaultRadiusTimeout is the timeout of a single RADIUS request if none is configured.
+	defaultRadiusTimeout = 3 * time.Second
+)
+
+var (
+	// errRadiusReject is returned when the RADIUS server rejects the credentials.
+	errRadiusReject = fmt.Errorf("rejected by RADIUS server: %w", errUserAuthFailed)
+
+	// errRadiusNoServer is returned when no RADIUS server is configured.
+	errRadiusNoServer = errors.New("no RADIUS server configured")
+)
+
+// RadiusClient is a RADIUS client for authentication and accounting of sessions.
+//
+// It implements the CredentialStore and CredentialVerifier interfaces by sending a PAP Access-Request
+// for the user name and password of the client, so it is used as the credential store of a
+// UserPassAuthenticator. Reply attributes are mapped into the session: Session-Timeout becomes the
+// expiry of the session and Filter-Id selects the rules of the session from Filters.
+//
+// It also implements the Accounting interface. When AccountingServers are configured, Start, Stop and
+// Interim-Update records carrying the byte counters of the session are sent for every session.
+//
+// Servers are tried in order, each with the configured number of retries, so later servers act as failover.
+type RadiusClient struct {
+	// Servers are the addresses of the authentication servers, e.g. "10.0.0.1:1812".
+	Servers []string
+
+	// AccountingServers are the addresses of the accounting servers, e.g. "10.0.0.1:1813".
+	// Accounting is disabled if empty.
+	AccountingServers []string
+
+	// Secret is the shared secret with the servers.
+	Secret []byte
+
+	// Timeout is how long to wait for a reply before retrying.
+	// Defaults to 3 seconds.
+	Timeout time.Duration
+
+	// Retries is the number of times a request is retransmitted to a server before failing over to the next one.
+	Retries int
+
+	// NASIdentifier is sent as NAS-Identifier in every request if not empty.
+	NASIdentifier string
+
+	// NASIPAddress is sent as NAS-IP-Address in every request if it is an IPv4 address.
+	NASIPAddress net.IP
+
+	// Filters maps the Filter-Id reply attribute to the rules of the session.
+	// Clients accepted with a Filter-Id that is not in Filters are denied.
+	Filters map[string]RuleSet
+
+	// InterimInterval is the interval of Interim-Update records. Zero disables interim updates.
+	InterimInterval time.Duration
+
+	ids      atomic.Uint32
+	sessions sync.Map // Records of a session in progress by *Session, see SessionStop
+}
+
+// radiusSessionPrefix is the random prefix of Acct-Session-Id. Session IDs are only unique within a process,
+// the prefix keeps them unique across restarts and instances of the proxy.
+var radiusSessionPrefix = func() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x", b)
+}()
+
+// radiusPacket is a decoded RADIUS packet.
+type radiusPacket struct {
+	code          uint8
+	id            uint8
+	authenticator [16]byte
+	attrs         []radiusAttr
+}
+
+// radiusAttr is a RADIUS attribute.
+type radiusAttr struct {
+	typ   uint8
+	value []byte
+}
+
+// Valid checks if the given user and password combination is accepted by the RADIUS servers.
+// It is equivalent to VerifyCredentials without connection metadata.
+func (r *RadiusClient) Valid(user, password string) bool {
+	_, err := r.VerifyCredentials(context.Background(), nil, user, password)
+	return err == nil
+}
+
+// VerifyCredentials sends an Access-Request for the user and password and maps the reply attributes
+// into the AuthContext of the session. Filter-Id, Class and Reply-Message are also stored in the payload.
+func (r *RadiusClient) VerifyCredentials(ctx context.Context, meta *ConnMetadata, user, password string) (*AuthContext, error) {
+	if len(password) > radiusMaxPassword {
+		return nil, fmt.Errorf("%w: password longer than %v bytes", errUserAuthFailed, radiusMaxPassword)
+	}
+	req := &radiusPacket{code: radiusAccessRequest}
+	if _, err := rand.Read(req.authenticator[:]); err != nil {
+		return nil, err
+	}
+	req.add(radiusUserName, []byte(user))
+	req.add(radiusUserPassword, radiusHidePassword([]byte(password), r.Secret, req.authenticator[:]))
+	r.addNAS(req)
+	if meta != nil {
+		if ip := addrIP(meta.RemoteAddr); ip != nil {
+			req.add(radiusCallingStationID, []byte(ip.String()))
+		}
+	}
+	// Message-Authenticator protects the request, it is computed once all other attributes are added
+	req.add(radiusMessageAuthenticator, make([]byte, md5.Size))
+
+	resp, err := r.exchange(ctx, r.Servers, req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.code {
+	case radiusAccessAccept:
+	case radiusAccessReject:
+		return nil, errRadiusReject
+	default:
+		return nil, fmt.Errorf("unexpected RADIUS reply code %v", resp.code)
+	}
+
+	authContext := &AuthContext{Method: UserPassAuth, Payload: map[string]string{}}
+	if v, ok := resp.get(radiusSessionTimeout); ok && len(v) == 4 {
+		authContext.Expires = time.Now().Add(time.Duration(binary.BigEndian.Uint32(v)) * time.Second)
+	}
+	if v, ok := resp.get(radiusFilterID); ok {
+		filter := string(v)
+		rules, found := r.Filters[filter]
+		if !found {
+			return nil, fmt.Errorf("%w: unknown RADIUS Filter-Id %q", errUserAuthFailed, filter)
+		}
+		authContext.Rules = rules
+		authContext.Payload["Filter-Id"] = filter
+	}
+	if v, ok := resp.get(radiusClass); ok {
+		authContext.Payload["Class"] = string(v)
+	}
+	if v, ok := resp.get(radiusReplyMessage); ok {
+		authContext.Payload["Reply-Message"] = string(v)
+	}
+	return authContext, nil
+}
+
+// SessionStart sends an accounting Start record and starts sending Interim-Update records.
+func (r *RadiusClient) SessionStart(s *Session) {
+	if len(r.AccountingServers) == 0 {
+		return
+	}
+	// Stop waits for Start and the Interim-Update records, so the server receives them in order
+	done := make(chan struct{})
+	r.sessions.Store(s, done)
+	go func() {
+		defer close(done)
+		r.report(s, radiusAcctStart)
+		if r.InterimInterval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(r.InterimInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.report(s, radiusAcctInterim)
+			case <-s.Done():
+				return
+			}
+		}
+	}()
+}
+
+// SessionStop sends an accounting Stop record with the final byte counters of the session.
+func (r *RadiusClient) SessionStop(s *Session) {
+	if len(r.AccountingServers) == 0 {
+		return
+	}
+	go func() {
+		if done, ok := r.sessions.LoadAndDelete(s); ok {
+			<-done.(chan struct{})
+		}
+		r.report(s, radiusAcctStop)
+	}()
+}
+
+// report sends an accounting record and logs a failure to send it.
+func (r *RadiusClient) report(s *Session, status uint32) {
+	if err := r.account(s, status); err != nil {
+		s.logf("[ERR] socks: Failed to send RADIUS accounting record of session %v: %v", s.ID, err)
+	}
+}
+
+// account sends an accounting record of the given status type for the session.
+func (r *RadiusClient) account(s *Session, status uint32) error {
+	req := &radiusPacket{code: radiusAccountingRequest}
+	req.addUint32(radiusAcctStatusType, status)
+	req.add(radiusAcctSessionID, []byte(fmt.Sprintf("%s-%08x", radiusSessionPrefix, s.ID)))
+	if s.User != "" {
+		req.add(radiusUserName, []byte(s.User))
+	}
+	if ip := addrIP(s.RemoteAddr); ip != nil {
+		req.add(radiusCallingStationID, []byte(ip.String()))
+	}
+	r.addNAS(req)
+	if s.AuthContext != nil {
+		if class, ok := s.AuthContext.Payload["Class"]; ok {
+			req.add(radiusClass, []byte(class))
+		}
+	}
+	if status != radiusAcctStart {
+		in, out := uint64(s.BytesIn()), uint64(s.BytesOut())
+		req.addUint32(radiusAcctSessionTime, uint32(time.Since(s.Started)/time.Second))
+		req.addUint32(radiusAcctInputOctets, uint32(in))
+		req.addUint32(radiusAcctInputGigawords, uint32(in>>32))
+		req.addUint32(radiusAcctOutputOctets, uint32(out))
+		req.addUint32(radiusAcctOutputGigawords, uint32(out>>32))
+	}
+	if status == radiusAcctStop {
+		cause := radiusCauseAdminReset
+		switch s.Reason() {
+		case ReasonClientClosed:
+			cause = radiusCauseUserRequest
+		case ReasonExpired:
+			cause = radiusCauseSessionTimeout
+		}
+		req.addUint32(radiusAcctTerminateCause, cause)
+	}
+
+	resp, err := r.exchange(context.Background(), r.AccountingServers, req)
+	if err != nil {
+		return err
+	}
+	if resp.code != radiusAccountingResponse {
+		return fmt.Errorf("unexpected RADIUS reply code %v", resp.code)
+	}
+	return nil
+}
+
+// addNAS adds the attributes identifying the proxy to the request.
+func (r *RadiusClient) addNAS(req *radiusPacket) {
+	if r.NASIdentifier != "" {
+		req.add(radiusNASIdentifier, []byte(r.NASIdentifier))
+	}
+	if ip := r.NASIPAddress.To4(); ip != nil {
+		req.add(radiusNASIPAddress, ip)
+	}
+	req.addUint32(radiusNASPortType, radiusNASPortVirtual)
+}
+
+// exchange sends the request to the servers in order until one of them replies.
+func (r *RadiusClient) exchange(ctx context.Context, servers []string, req *radiusPacket) (*radiusPacket, error) {
+	if len(servers) == 0 {
+		return nil, errRadiusNoServer
+	}
+	req.id = uint8(r.ids.Add(1))
+	msg, err := req.encode(r.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, server := range servers {
+		resp, err := r.exchangeServer(ctx, server, req, msg)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, fmt.Sprintf("%v: %v", server, err))
+	}
+	return nil, fmt.Errorf("RADIUS request failed: %v", strings.Join(errs, "; "))
+}
+
+// exchangeServer sends the encoded request to a server, retransmitting it on timeout.
+func (r *RadiusClient) exchangeServer(ctx context.Context, server string, req *radiusPacket, msg []byte) (*radiusPacket, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultRadiusTimeout
+	}
+	// Replies to requests with a Message-Authenticator must carry one too, see RFC 3579 section 3.2
+	_, required := req.get(radiusMessageAuthenticator)
+	buf := make([]byte, radiusMaxPacket)
+	for attempt := 0; attempt <= r.Retries; attempt++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && ctx.Err() == nil {
+					break
+				}
+				return nil, err
+			}
+			// Ignore stray or forged replies and keep waiting for the right one
+			resp, err := decodeRadiusPacket(buf[:n])
+			if err != nil || resp.id != req.id || !radiusVerifyResponse(buf[:n], msg[4:20], r.Secret) {
+				continue
+			}
+			if !radiusVerifyMessageAuthenticator(buf[:n], msg[4:20], r.Secret, required) {
+				continue
+			}
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("no reply after %v attempts", r.Retries+1)
+}
+
+// add appends an attribute to the packet.
+func (p *radiusPacket) add(typ uint8, value []byte) {
+	p.attrs = append(p.attrs, radiusAttr{typ: typ, value: value})
+}
+
+// addUint32 appends an integer attribute to the packet.
+func (p *radiusPacket) addUint32(typ uint8, value uint32) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, value)
+	p.add(typ, v)
+}
+
+// get returns the value of the first attribute of the given type.
+func (p *radiusPacket) get(typ uint8) ([]byte, bool) {
+	for _, attr := range p.attrs {
+		if attr.typ == typ {
+			return attr.value, true
+		}
+	}
+	return nil, false
+}
+
+// encode serializes the packet. Accounting requests get their request authenticator and packets
+// with a Message-Authenticator attribute get its HMAC computed with secret.
+func (p *radiusPacket) encode(secret []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{p.code, p.id, 0, 0})
+	buf.Write(p.authenticator[:])
+	msgAuth := -1
+	for _, attr := range p.attrs {
+		if len(attr.value) > 253 {
+			return nil, fmt.Errorf("RADIUS attribute %v too long", attr.typ)
+		}
+		if attr.typ == radiusMessageAuthenticator {
+			msgAuth = buf.Len() + 2
+		}
+		buf.Write([]byte{attr.typ, byte(len(attr.value) + 2)})
+		buf.Write(attr.value)
+	}
+	if buf.Len() > radiusMaxPacket {
+		return nil, errors.New("RADIUS packet too long")
+	}
+	msg := buf.Bytes()
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+
+	if p.code == radiusAccountingRequest {
+		sum := md5.Sum(append(append([]byte{}, msg...), secret...))
+		copy(msg[4:20], sum[:])
+	}
+	if msgAuth >= 0 {
+		mac := hmac.New(md5.New, secret)
+		mac.Write(msg)
+		copy(msg[msgAuth:msgAuth+md5.Size], mac.Sum(nil))
+	}
+	return msg, nil
+}
+
+// decodeRadiusPacket parses a RADIUS packet.
+func decodeRadiusPacket(b []byte) (*radiusPacket, error) {
+	if len(b) < radiusHeaderLen {
+		return nil, errors.New("RADIUS packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < radiusHeaderLen || length > len(b) {
+		return nil, errors.New("invalid RADIUS packet length")
+	}
+	p := &radiusPacket{code: b[0], id: b[1]}
+	copy(p.authenticator[:], b[4:20])
+	for attrs := b[radiusHeaderLen:length]; len(attrs) > 0; {
+		if len(attrs) < 2 || int(attrs[1]) < 2 || int(attrs[1]) > len(attrs) {
+			return nil, errors.New("invalid RADIUS attribute")
+		}
+		p.add(attrs[0], attrs[2:attrs[1]])
+		attrs = attrs[attrs[1]:]
+	}
+	return p, nil
+}
+
+// radiusVerifyResponse checks the response authenticator of a reply to a request with the given authenticator.
+func radiusVerifyResponse(resp, reqAuthenticator, secret []byte) bool {
+	length := int(binary.BigEndian.Uint16(resp[2:4]))
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(reqAuthenticator)
+	h.Write(resp[20:length])
+	h.Write(secret)
+	return hmac.Equal(h.Sum(nil), resp[4:20])
+}
+
+// radiusMessageAuthenticatorOffset returns the offset of the value of the Message-Authenticator attribute
+// of an encoded packet, or -1 if it has none.
+func radiusMessageAuthenticatorOffset(msg []byte) int {
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	for i := radiusHeaderLen; i+2 <= length; i += int(msg[i+1]) {
+		if msg[i+1] < 2 {
+			return -1
+		}
+		if msg[i] == radiusMessageAuthenticator && msg[i+1] == 2+md5.Size && i+2+md5.Size <= length {
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// radiusVerifyMessageAuthenticator checks the Message-Authenticator of a reply to a request with the given
+// authenticator, see RFC 3579 section 3.2. A reply without the attribute is only accepted if it is not required.
+func radiusVerifyMessageAuthenticator(resp, reqAuthenticator, secret []byte, required bool) bool {
+	offset := radiusMessageAuthenticatorOffset(resp)
+	if offset < 0 {
+		return !required
+	}
+	length := int(binary.BigEndian.Uint16(resp[2:4]))
+	msg := append([]byte{}, resp[:length]...)
+	copy(msg[4:20], reqAuthenticator)
+	clear(msg[offset : offset+md5.Size])
+	mac := hmac.New(md5.New, secret)
+	mac.Write(msg)
+	return hmac.Equal(mac.Sum(nil), resp[offset:offset+md5.Size])
+}
+
+// radiusHidePassword encodes a User-Password attribute as described in RFC 2865 section 5.2.
+func radiusHidePassword(password, secret, authenticator []byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	prev := authenticator
+	for i := 0; i < len(padded); i += 16 {
+		sum := md5.Sum(append(append([]byte{}, secret...), prev...))
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= sum[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
@@ -0,0 +1,301 @@
+package socks5
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// radiusStandIn is an in-process RADIUS server for tests.
+type radiusStandIn struct {
+	conn    *net.UDPConn
+	secret  []byte
+	handle  func(req *radiusPacket) *radiusPacket
+	packets chan *radiusPacket
+
+	// Reply without or with a wrong Message-Authenticator
+	omitMessageAuth  atomic.Bool
+	forgeMessageAuth atomic.Bool
+}
+
+func newRadiusStandIn(t *testing.T, secret []byte, handle func(req *radiusPacket) *radiusPacket) *radiusStandIn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r := &radiusStandIn{conn: conn, secret: secret, handle: handle, packets: make(chan *radiusPacket, 16)}
+	go r.serve()
+	return r
+}
+
+func (r *radiusStandIn) serve() {
+	buf := make([]byte, radiusMaxPacket)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := decodeRadiusPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		r.packets <- req
+		resp := r.handle(req)
+		resp.id = req.id
+		if _, ok := req.get(radiusMessageAuthenticator); ok && !r.omitMessageAuth.Load() {
+			resp.add(radiusMessageAuthenticator, make([]byte, md5.Size))
+		}
+		msg, _ := resp.encode(nil)
+		copy(msg[4:20], req.authenticator[:])
+		if offset := radiusMessageAuthenticatorOffset(msg); offset >= 0 {
+			clear(msg[offset : offset+md5.Size])
+			mac := hmac.New(md5.New, r.secret)
+			mac.Write(msg)
+			copy(msg[offset:], mac.Sum(nil))
+			if r.forgeMessageAuth.Load() {
+				msg[offset] ^= 0xff
+			}
+		}
+		sum := md5.Sum(append(append([]byte{}, msg...), r.secret...))
+		copy(msg[4:20], sum[:])
+		r.conn.WriteToUDP(msg, from)
+	}
+}
+
+func revealRadiusPassword(secret []byte, req *radiusPacket) string {
+	hidden, _ := req.get(radiusUserPassword)
+	password := make([]byte, len(hidden))
+	prev := req.authenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		sum := md5.Sum(append(append([]byte{}, secret...), prev...))
+		for j := 0; j < 16; j++ {
+			password[i+j] = hidden[i+j] ^ sum[j]
+		}
+		prev = hidden[i : i+16]
+	}
+	for len(password) > 0 && password[len(password)-1] == 0 {
+		password = password[:len(password)-1]
+	}
+	return string(password)
+}
+
+func TestRadiusClient(t *testing.T) {
+	secret := []byte("s3cret")
+	auth := newRadiusStandIn(t, secret, func(req *radiusPacket) *radiusPacket {
+		user, _ := req.get(radiusUserName)
+		if string(user) != "foo" || revealRadiusPassword(secret, req) != "bar" {
+			return &radiusPacket{code: radiusAccessReject}
+		}
+		resp := &radiusPacket{code: radiusAccessAccept}
+		resp.addUint32(radiusSessionTimeout, 60)
+		resp.add(radiusFilterID, []byte("db-only"))
+		resp.add(radiusClass, []byte("gold"))
+		return resp
+	})
+	defer auth.conn.Close()
+
+	// A server that is down is failed over
+	down, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	downAddr := down.LocalAddr().String()
+	down.Close()
+
+	dbOnly, _ := PermitDestinations("db.internal:5432")
+	client := &RadiusClient{
+		Servers: []string{downAddr, auth.conn.LocalAddr().String()},
+		Secret:  secret,
+		Timeout: 100 * time.Millisecond,
+		Filters: map[string]RuleSet{"db-only": dbOnly},
+	}
+
+	meta := &ConnMetadata{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}
+	ctx, err := client.VerifyCredentials(context.Background(), meta, "foo", "bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Rules != dbOnly || ctx.Payload["Class"] != "gold" {
+		t.Fatalf("bad context: %#v", ctx)
+	}
+	if remaining := time.Until(ctx.Expires); remaining < 59*time.Second || remaining > time.Minute {
+		t.Fatalf("bad expiry: %v", ctx.Expires)
+	}
+	req := <-auth.packets
+	if station, _ := req.get(radiusCallingStationID); string(station) != "10.0.0.1" {
+		t.Fatalf("bad Calling-Station-Id: %q", station)
+	}
+
+	if client.Valid("foo", "baz") {
+		t.Fatalf("expect reject")
+	}
+
+	// A Filter-Id without rules and a password User-Password cannot carry are rejections
+	client.Filters = nil
+	if _, err := client.VerifyCredentials(context.Background(), meta, "foo", "bar"); !errors.Is(err, ErrCredentialsRejected) {
+		t.Fatalf("expect unknown Filter-Id to be rejected, got %v", err)
+	}
+	<-auth.packets
+	if _, err := client.VerifyCredentials(context.Background(), meta, "foo", strings.Repeat("x", 129)); !errors.Is(err, ErrCredentialsRejected) {
+		t.Fatalf("expect long password to be rejected, got %v", err)
+	}
+}
+
+func TestRadiusClient_MessageAuthenticator(t *testing.T) {
+	secret := []byte("s3cret")
+	auth := newRadiusStandIn(t, secret, func(req *radiusPacket) *radiusPacket {
+		return &radiusPacket{code: radiusAccessAccept}
+	})
+	defer auth.conn.Close()
+	client := &RadiusClient{
+		Servers: []string{auth.conn.LocalAddr().String()},
+		Secret:  secret,
+		Timeout: 100 * time.Millisecond,
+	}
+
+	if !client.Valid("foo", "bar") {
+		t.Fatalf("expect accept with a valid Message-Authenticator")
+	}
+
+	// A reply with a valid Response Authenticator but a forged or stripped Message-Authenticator is dropped
+	auth.forgeMessageAuth.Store(true)
+	if client.Valid("foo", "bar") {
+		t.Fatalf("expect forged Message-Authenticator to be rejected")
+	}
+	auth.forgeMessageAuth.Store(false)
+	auth.omitMessageAuth.Store(true)
+	if client.Valid("foo", "bar") {
+		t.Fatalf("expect missing Message-Authenticator to be rejected")
+	}
+}
+
+func TestRadiusClient_Accounting(t *testing.T) {
+	secret := []byte("s3cret")
+	acct := newRadiusStandIn(t, secret, func(req *radiusPacket) *radiusPacket {
+		return &radiusPacket{code: radiusAccountingResponse}
+	})
+	defer acct.conn.Close()
+
+	client := &RadiusClient{
+		AccountingServers: []string{acct.conn.LocalAddr().String()},
+		Secret:            secret,
+		InterimInterval:   20 * time.Millisecond,
+	}
+
+	session := newSession(&net.TCPConn{}, nil)
+	session.ID = 7
+	session.User = "foo"
+	session.Started = time.Now()
+	session.addIn(100)
+	session.addOut(200)
+
+	statusOf := func(p *radiusPacket) uint32 {
+		v, _ := p.get(radiusAcctStatusType)
+		return binary.BigEndian.Uint32(v)
+	}
+
+	client.SessionStart(session)
+	if p := <-acct.packets; statusOf(p) != radiusAcctStart {
+		t.Fatalf("expect Start, got %v", statusOf(p))
+	}
+	if p := <-acct.packets; statusOf(p) != radiusAcctInterim {
+		t.Fatalf("expect Interim-Update, got %v", statusOf(p))
+	}
+
+	session.once.Do(func() {
+		session.reason = ReasonRevoked
+		close(session.done)
+	})
+	client.SessionStop(session)
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case p := <-acct.packets:
+			if statusOf(p) != radiusAcctStop {
+				continue
+			}
+			if id, _ := p.get(radiusAcctSessionID); string(id) != radiusSessionPrefix+"-00000007" || len(radiusSessionPrefix) != 16 {
+				t.Fatalf("bad Acct-Session-Id %q", id)
+			}
+			in, _ := p.get(radiusAcctInputOctets)
+			out, _ := p.get(radiusAcctOutputOctets)
+			cause, _ := p.get(radiusAcctTerminateCause)
+			if binary.BigEndian.Uint32(in) != 100 || binary.BigEndian.Uint32(out) != 200 {
+				t.Fatalf("bad counters")
+			}
+			if binary.BigEndian.Uint32(cause) != radiusCauseAdminReset {
+				t.Fatalf("bad terminate cause")
+			}
+			return
+		case <-deadline:
+			t.Fatalf("expect Stop")
+		}
+	}
+}
+
+// logLines is a log output sending every line to a channel.
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func TestRadiusClient_AccountingError(t *testing.T) {
+	secret := []byte("s3cret")
+	acct := newRadiusStandIn(t, secret, func(req *radiusPacket) *radiusPacket {
+		return &radiusPacket{code: radiusAccessReject}
+	})
+	defer acct.conn.Close()
+	client := &RadiusClient{
+		AccountingServers: []string{acct.conn.LocalAddr().String()},
+		Secret:            secret,
+	}
+
+	lines := make(logLines, 2)
+	session := newSession(&net.TCPConn{}, log.New(lines, "", 0))
+	session.ID = 3
+	session.Started = time.Now()
+	client.SessionStart(session)
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, "session 3") || !strings.Contains(line, "unexpected RADIUS reply code") {
+			t.Fatalf("bad log line %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect failed accounting to be logged")
+	}
+}
+
+func TestRadiusClient_AccountingOrder(t *testing.T) {
+	secret := []byte("s3cret")
+	acct := newRadiusStandIn(t, secret, func(req *radiusPacket) *radiusPacket {
+		return &radiusPacket{code: radiusAccountingResponse}
+	})
+	defer acct.conn.Close()
+	client := &RadiusClient{
+		AccountingServers: []string{acct.conn.LocalAddr().String()},
+		Secret:            secret,
+	}
+
+	// Stop follows Start even if the session ends right away
+	for i := 0; i < 10; i++ {
+		session := newSession(&net.TCPConn{}, nil)
+		session.ID = uint64(i)
+		session.Started = time.Now()
+		client.SessionStart(session)
+		session.once.Do(func() { close(session.done) })
+		client.SessionStop(session)
+		for _, status := range []uint32{radiusAcctStart, radiusAcctStop} {
+			p := <-acct.packets
+			if v, _ := p.get(radiusAcctStatusType); binary.BigEndian.Uint32(v) != status {
+				t.Fatalf("expect status %v, got %v", status, binary.BigEndian.Uint32(v))
+			}
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"strings"
 )
 
 const (
@@ -75,9 +74,15 @@ type Request struct {
 	RemoteAddr *AddrSpec
 	// AddrSpec of the desired destination
 	DestAddr *AddrSpec
+	// Datagram is set when the request checks the destination of a datagram relayed by
+	// an association, rather than being the ASSOCIATE request whose DestAddr is the
+	// source of the client. Rules see one such request per new destination.
+	Datagram bool
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
 	bufConn      io.Reader
+	// session the request belongs to, nil if unknown
+	session *Session
 }
 
 type conn interface {
@@ -118,24 +123,13 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 func (s *Server) handleRequest(req *Request, conn conn) error {
 	ctx := context.Background()
 
-	// Resolve the address if we have a FQDN
-	dest := req.DestAddr
-	if dest.FQDN != "" {
-		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
-		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
-				return fmt.Errorf("failed to send reply: %v", err)
-			}
-			return fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+	// Resolve the address if we have a FQDN and apply any address rewrites
+	ctx, err := s.resolveRequest(ctx, req)
+	if err != nil {
+		if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		ctx = ctx_
-		dest.IP = addr
-	}
-
-	// Apply any address rewrites
-	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+		return err
 	}
 
 	// Switch on the command
@@ -154,10 +148,30 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 	}
 }
 
+// resolveRequest resolves the destination of the request if it is a FQDN
+// and applies any address rewrites.
+func (s *Server) resolveRequest(ctx context.Context, req *Request) (context.Context, error) {
+	dest := req.DestAddr
+	if dest.FQDN != "" {
+		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return ctx, fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+		}
+		ctx = ctx_
+		dest.IP = addr
+	}
+
+	req.realDestAddr = req.DestAddr
+	if s.config.Rewriter != nil {
+		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	}
+	return ctx, nil
+}
+
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+	if ctx_, ok := s.allow(ctx, req); !ok {
 		if err := sendReply(conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
@@ -175,14 +189,7 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	}
 	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
 	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
-		}
-		if err := sendReply(conn, resp, nil); err != nil {
+		if err := sendReply(conn, errToReply(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return fmt.Errorf("connect to %v failed: %v", req.DestAddr, err)
@@ -217,7 +224,7 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
 	// Check if the bind request is allowed according to the server's rules.
 	// If the request is not allowed, send a failure reply and return an error.
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+	if ctx_, ok := s.allow(ctx, req); !ok {
 		if err := sendReply(conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
@@ -238,7 +245,7 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 // It checks if the association is allowed based on the server's rules and then proceeds to establish the association.
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
 	// Check if the association is allowed based on the server's rules.
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
+	if ctx_, ok := s.allow(ctx, req); !ok {
 		// If not allowed, send a rule failure reply to the client.
 		if err := sendReply(conn, ruleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
@@ -256,6 +263,18 @@ func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) e
 	return doAssociate(ctx, s, conn, req)
 }
 
+// allow checks the request against the RuleSet of the server and the rules of the session, if any.
+func (s *Server) allow(ctx context.Context, req *Request) (context.Context, bool) {
+	ctx, ok := s.config.Rules.Allow(ctx, req)
+	if !ok {
+		return ctx, false
+	}
+	if req.AuthContext != nil && req.AuthContext.Rules != nil {
+		return req.AuthContext.Rules.Allow(ctx, req)
+	}
+	return ctx, true
+}
+
 // readAddrSpec is used to read AddrSpec.
 // Expects an address type byte, follwed by the address and port
 func readAddrSpec(r io.Reader) (*AddrSpec, error) {
@@ -2,7 +2,9 @@ package socks5
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -207,3 +209,38 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		// No error from the listener goroutine
 	}
 }
+
+func TestErrToReply(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	cases := []struct {
+		err  error
+		code uint8
+	}{
+		{nil, successReply},
+		{opErr(errnoConnRefused), connectionRefused},
+		{opErr(errnoNetUnreach), networkUnreachable},
+		{opErr(errnoHostUnreach), hostUnreachable},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), ttlExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, ttlExpired},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, hostUnreachable},
+		{errors.New("connection refused"), hostUnreachable},
+	}
+	for _, c := range cases {
+		if code := errToReply(c.err); code != c.code {
+			t.Errorf("%v: expect %v, got %v", c.err, Reply2String(c.code), Reply2String(code))
+		}
+	}
+}
+
+func TestDialer_ReplyError(t *testing.T) {
+	closed := closedAddr(t)
+	_, server := startServer(t, "tcp", "127.0.0.1:0", &Config{})
+	dial := &Dialer{ProxyNetwork: "tcp", ProxyAddress: server}
+	_, err := dial.Dial("tcp", closed)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != connectionRefused {
+		t.Fatalf("expect connection refused reply, got %v", err)
+	}
+}
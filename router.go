@@ -0,0 +1,203 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+const (
+	// defaultRetryAfter is the default time a failed proxy is tried last by a Router.
+	defaultRetryAfter = 30 * time.Second
+)
+
+var (
+	_ netproxy.Dialer        = (*Router)(nil)
+	_ netproxy.ContextDialer = (*Router)(nil)
+)
+
+// Router is a dialer that chooses per destination between direct connections and proxies, like a PAC file.
+//
+// Each route has destination patterns and proxies, the first route matching a destination is used.
+// The proxies of a route are tried in order until one connects, proxy.Direct connects directly.
+// Proxies that failed recently are tried after the others, see RetryAfter and Health.
+// The health of a proxy is tracked per route, so a dialer used by several routes has a state in each.
+type Router struct {
+	// RetryAfter is how long a failed proxy is tried after the healthy ones.
+	// The default is 30 seconds
+	RetryAfter time.Duration
+
+	mu       sync.Mutex // Guards the routes and the health of their proxies
+	routes   []*route
+	fallback *route
+}
+
+// route is a route of a Router.
+type route struct {
+	patterns []*addrPattern
+	proxies  []*routerProxy
+}
+
+// routerProxy is a proxy of a route with its health state.
+type routerProxy struct {
+	dialer netproxy.ContextDialer
+	health ProxyHealth
+}
+
+// newRoute returns a route through the proxies.
+func newRoute(index int, patterns []*addrPattern, dialers []netproxy.ContextDialer) *route {
+	rt := &route{patterns: patterns}
+	for i, dialer := range dialers {
+		rt.proxies = append(rt.proxies, &routerProxy{
+			dialer: dialer,
+			health: ProxyHealth{Route: index, Proxy: i, Dialer: dialer},
+		})
+	}
+	return rt
+}
+
+// ProxyHealth is the health state of a proxy of a Router.
+type ProxyHealth struct {
+	// Route is the index of the route in the order the routes were added, -1 for the fallback proxies
+	Route int
+	// Proxy is the index of the proxy within its route
+	Proxy int
+	// Dialer is the proxy
+	Dialer netproxy.ContextDialer
+
+	// Failures is the number of consecutive failed connections
+	Failures int
+	// LastError is the error of the last failed connection
+	LastError error
+	// LastFailure is the time of the last failed connection
+	LastFailure time.Time
+	// LastSuccess is the time of the last successful connection
+	LastSuccess time.Time
+}
+
+// NewRouter returns a Router which dials destinations matching no route through the fallback proxies,
+// or directly if there are none.
+func NewRouter(fallback ...netproxy.ContextDialer) *Router {
+	if len(fallback) == 0 {
+		fallback = []netproxy.ContextDialer{netproxy.Direct}
+	}
+	return &Router{fallback: newRoute(-1, nil, fallback)}
+}
+
+// Route adds a route for the destinations matching one of the patterns, see PermitDestinations for their syntax.
+// Domain names are matched without resolving them. Routes are matched in the order they were added.
+func (r *Router) Route(patterns []string, proxies ...netproxy.ContextDialer) error {
+	if len(proxies) == 0 {
+		return errors.New("route without proxies")
+	}
+	parsed, err := parseAddrPatterns(patterns)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = append(r.routes, newRoute(len(r.routes), parsed, proxies))
+	return nil
+}
+
+// Health returns the health state of all proxies, the fallback proxies first, then the proxies
+// of the routes in the order the routes were added.
+func (r *Router) Health() []ProxyHealth {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var health []ProxyHealth
+	for _, rt := range append([]*route{r.fallback}, r.routes...) {
+		for _, p := range rt.proxies {
+			health = append(health, p.health)
+		}
+	}
+	return health
+}
+
+// proxies returns the proxies for a destination, healthy ones first.
+func (r *Router) proxies(address string) []*routerProxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	proxies := r.fallback.proxies
+	for _, rt := range r.routes {
+		if matchAddress(rt.patterns, address) {
+			proxies = rt.proxies
+			break
+		}
+	}
+
+	retryAfter := r.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	ordered := make([]*routerProxy, 0, len(proxies))
+	var failed []*routerProxy
+	for _, proxy := range proxies {
+		if h := proxy.health; h.Failures > 0 && time.Since(h.LastFailure) < retryAfter {
+			failed = append(failed, proxy)
+		} else {
+			ordered = append(ordered, proxy)
+		}
+	}
+	return append(ordered, failed...)
+}
+
+// report updates the health state of a proxy.
+func (r *Router) report(proxy *routerProxy, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := &proxy.health
+	if err != nil {
+		h.Failures++
+		h.LastError = err
+		h.LastFailure = time.Now()
+	} else {
+		h.Failures = 0
+		h.LastSuccess = time.Now()
+	}
+}
+
+// DialContext connects to the provided address on the provided network through the proxies of its route.
+// A failure reply of a proxy server, e.g. because the destination refused the connection, falls back to
+// the next proxy without counting as a failure of the proxy.
+func (r *Router) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var errs []error
+	for _, proxy := range r.proxies(address) {
+		conn, err := proxy.dialer.DialContext(ctx, network, address)
+		if err == nil {
+			r.report(proxy, nil)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if destinationFailed(err) {
+			r.report(proxy, nil)
+		} else {
+			r.report(proxy, err)
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("failed to dial %v: %w", address, errors.Join(errs...))
+}
+
+// destinationFailed tells if err is a failure reply for the destination, which does not make a proxy unhealthy.
+// Replies of a hop before the last one of a Chain are failures of the chain.
+func destinationFailed(err error) bool {
+	var hopErr *HopError
+	if errors.As(err, &hopErr) && !hopErr.last {
+		return false
+	}
+	var replyErr *ReplyError
+	return errors.As(err, &replyErr)
+}
+
+// Dial connects to the provided address on the provided network through the proxies of its route.
+func (r *Router) Dial(network, address string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, address)
+}
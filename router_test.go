@@ -0,0 +1,186 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// countingProxy returns a Dialer for a proxy server that counts its connections to the server.
+func countingProxy(server string, dials *atomic.Int32) *Dialer {
+	return &Dialer{
+		ProxyNetwork: "tcp",
+		ProxyAddress: server,
+		ProxyDial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func TestRouter_Route(t *testing.T) {
+	internalEcho := startTCPEcho(t)
+	partnerEcho := startTCPEcho(t)
+	directEcho := startTCPEcho(t)
+	_, internalServer := startServer(t, "tcp", "127.0.0.1:0", &Config{
+		Resolver: staticResolver{"wiki.corp.test": net.ParseIP("127.0.0.1")},
+	})
+	_, partnerServer := startServer(t, "tcp", "127.0.0.1:0", &Config{})
+
+	var internalDials, partnerDials atomic.Int32
+	internal := countingProxy(internalServer, &internalDials)
+	partner := countingProxy(partnerServer, &partnerDials)
+
+	r := NewRouter()
+	if err := r.Route([]string{"*.corp.test"}, internal); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := r.Route([]string{partnerEcho, "10.0.0.0/8"}, partner); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := r.Route([]string{"bad/pattern"}, partner); err == nil {
+		t.Fatalf("expect bad pattern to be rejected")
+	}
+
+	_, port, _ := net.SplitHostPort(internalEcho)
+	conn, err := r.Dial("tcp", net.JoinHostPort("wiki.corp.test", port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+
+	conn, err = r.Dial("tcp", partnerEcho)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+
+	conn, err = r.Dial("tcp", directEcho)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatalf("expect a direct connection, got %T", conn)
+	}
+	expectEcho(t, conn)
+
+	if internalDials.Load() != 1 || partnerDials.Load() != 1 {
+		t.Fatalf("expect one dial per proxy, got %v and %v", internalDials.Load(), partnerDials.Load())
+	}
+}
+
+func TestRouter_Fallback(t *testing.T) {
+	echo := startTCPEcho(t)
+	_, server := startServer(t, "tcp", "127.0.0.1:0", &Config{})
+	closed := closedAddr(t)
+
+	var deadDials, liveDials atomic.Int32
+	dead := countingProxy(closed, &deadDials)
+	live := countingProxy(server, &liveDials)
+	r := NewRouter(dead, live)
+
+	// The dead proxy fails and the next one is used
+	conn, err := r.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+	health := r.Health()
+	if len(health) != 2 {
+		t.Fatalf("bad health: %+v", health)
+	}
+	if h := health[0]; h.Route != -1 || h.Proxy != 0 || h.Dialer != dead || h.Failures != 1 || h.LastError == nil {
+		t.Fatalf("bad health of dead proxy: %+v", h)
+	}
+	if h := health[1]; h.Proxy != 1 || h.Dialer != live || h.Failures != 0 || h.LastSuccess.IsZero() {
+		t.Fatalf("bad health of live proxy: %+v", h)
+	}
+
+	// The failed proxy is tried last
+	conn, err = r.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+	if deadDials.Load() != 1 || liveDials.Load() != 2 {
+		t.Fatalf("expect failed proxy to be skipped, got %v and %v dials", deadDials.Load(), liveDials.Load())
+	}
+
+	// Failure replies do not make a proxy unhealthy
+	_, err = r.Dial("tcp", closed)
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != connectionRefused {
+		t.Fatalf("expect connection refused reply, got %v", err)
+	}
+	health = r.Health()
+	if h := health[1]; h.Failures != 0 {
+		t.Fatalf("bad health of live proxy: %+v", h)
+	}
+	if h := health[0]; h.Failures != 2 {
+		t.Fatalf("bad health of dead proxy: %+v", h)
+	}
+}
+
+// dialFunc is a dialer which is not comparable.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func TestRouter_NotComparable(t *testing.T) {
+	echo := startTCPEcho(t)
+	failing := dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("down")
+	})
+	r := NewRouter(failing, dialFunc(netproxy.Direct.DialContext))
+	if err := r.Route([]string{"*.corp.test"}, failing); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conn, err := r.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+	health := r.Health()
+	if len(health) != 3 || health[0].Failures != 1 || health[1].LastSuccess.IsZero() {
+		t.Fatalf("bad health: %+v", health)
+	}
+	if h := health[2]; h.Route != 0 || h.Proxy != 0 || h.Failures != 0 {
+		t.Fatalf("bad health of route proxy: %+v", h)
+	}
+}
+
+func TestRouter_ChainHopFailure(t *testing.T) {
+	echo := startTCPEcho(t)
+	_, a := startServer(t, "tcp", "127.0.0.1:0", &Config{Credentials: StaticCredentials{"alice": "a"}})
+	_, b := startServer(t, "tcp", "127.0.0.1:0", &Config{Credentials: StaticCredentials{"bob": "b"}})
+	closed := closedAddr(t)
+
+	// The first hop replies that the second one is unreachable, so the chain is unhealthy
+	broken, _ := ParseChain("socks5://alice:a@" + a + ",socks5://bob:b@" + closed)
+	working, _ := ParseChain("socks5://alice:a@" + a + ",socks5://bob:b@" + b)
+	r := NewRouter(broken, working)
+	conn, err := r.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectEcho(t, conn)
+	if h := r.Health()[0]; h.Failures != 1 {
+		t.Fatalf("bad health of broken chain: %+v", h)
+	}
+
+	// The last hop replies that the destination is unreachable, so the chain stays healthy
+	if _, err := r.Dial("tcp", closed); err == nil {
+		t.Fatalf("expect dial to fail")
+	}
+	if h := r.Health()[1]; h.Failures != 0 {
+		t.Fatalf("bad health of working chain: %+v", h)
+	}
+}
@@ -47,4 +47,41 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 	default:
 		return ctx, false
 	}
-}
\ No newline at end of file
+}
+
+// PermitDestinations returns a RuleSet which only allows requests to destinations matching one of the patterns.
+//
+// A pattern is a host optionally followed by ":port". The host is "*", a domain name, "*.domain" or ".domain"
+// matching all subdomains of domain, an IP address or a CIDR. The port is a number or "*", a missing port
+// matches any port. IPv6 addresses and networks must be enclosed in square brackets when a port is given.
+//
+// It is typically used as the per-session AuthContext.Rules to scope credentials to a set of destinations.
+func PermitDestinations(patterns ...string) (RuleSet, error) {
+	parsed, err := parseAddrPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &PermitDestination{patterns: parsed}, nil
+}
+
+// PermitDestination is an implementation of the RuleSet interface which enables filtering of destinations.
+// It is created by PermitDestinations.
+type PermitDestination struct {
+	// patterns are the destinations allowed.
+	patterns []*addrPattern
+}
+
+// Allow determines whether the destination of the given request matches one of the allowed patterns.
+// It returns the unchanged context and a boolean indicating whether the request is allowed.
+//
+// An ASSOCIATE request is allowed, since its address is the source of the client and the destination
+// of every datagram relayed by the association is checked separately with Request.Datagram set.
+func (p *PermitDestination) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.Command == AssociateCommand && !req.Datagram {
+		return ctx, true
+	}
+	if req.DestAddr == nil {
+		return ctx, false
+	}
+	return ctx, matchAddrPatterns(p.patterns, req.DestAddr.FQDN, req.DestAddr.IP, req.DestAddr.Port)
+}
@@ -1,8 +1,9 @@
 package socks5
 
 import (
-	"testing"
 	"context"
+	"net"
+	"testing"
 )
 
 func TestPermitCommand(t *testing.T) {
@@ -21,3 +22,46 @@ func TestPermitCommand(t *testing.T) {
 		t.Fatalf("do not expect associate")
 	}
 }
+
+func TestPermitDestinations(t *testing.T) {
+	ctx := context.Background()
+	r, err := PermitDestinations("db.internal:5432", "*.example.com", "10.0.0.0/8:443", "[::1]:22")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, tc := range []struct {
+		dest  AddrSpec
+		allow bool
+	}{
+		{AddrSpec{FQDN: "db.internal", Port: 5432}, true},
+		{AddrSpec{FQDN: "DB.internal.", Port: 5432}, true},
+		{AddrSpec{FQDN: "db.internal", Port: 5433}, false},
+		{AddrSpec{FQDN: "www.example.com", Port: 80}, true},
+		{AddrSpec{FQDN: "example.com", Port: 80}, false},
+		{AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 443}, true},
+		{AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 80}, false},
+		{AddrSpec{IP: net.ParseIP("::1"), Port: 22}, true},
+	} {
+		if _, ok := r.Allow(ctx, &Request{DestAddr: &tc.dest}); ok != tc.allow {
+			t.Fatalf("%v: expect %v", tc.dest.String(), tc.allow)
+		}
+	}
+
+	// The address of an ASSOCIATE request is the source of the client, datagrams are checked separately
+	source := &AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 4000}
+	if _, ok := r.Allow(ctx, &Request{Command: AssociateCommand, DestAddr: source}); !ok {
+		t.Fatalf("expect ASSOCIATE request to be allowed")
+	}
+	if _, ok := r.Allow(ctx, &Request{Command: AssociateCommand, DestAddr: source, Datagram: true}); ok {
+		t.Fatalf("expect datagram to be denied")
+	}
+	unspecified := &AddrSpec{IP: net.IPv4zero, Port: 5432}
+	if _, ok := r.Allow(ctx, &Request{Command: AssociateCommand, DestAddr: unspecified, Datagram: true}); ok {
+		t.Fatalf("expect datagram to the unspecified address to be denied")
+	}
+
+	if _, err := PermitDestinations("example.com:http"); err == nil {
+		t.Fatalf("expect error")
+	}
+}
@@ -0,0 +1,358 @@
+package socks5
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ReasonClientClosed is the session end reason when the client connection ended.
+	ReasonClientClosed = "client closed"
+
+	// ReasonExpired is the session end reason when the credentials of the session expired.
+	ReasonExpired = "credentials expired"
+
+	// ReasonRevoked is the default session end reason when the credentials of the session were revoked.
+	ReasonRevoked = "credentials revoked"
+)
+
+// Accounting is an interface used to track sessions, e.g. for billing or auditing.
+// The methods are called from the goroutine serving the session and must not block for long.
+type Accounting interface {
+	// SessionStart is called once a client is authenticated.
+	SessionStart(s *Session)
+
+	// SessionStop is called when the session ended. Session.Reason tells why.
+	SessionStop(s *Session)
+}
+
+// credentialRevoker is implemented by credential stores which can notify the server about revoked users,
+// so that the sessions of these users are terminated.
+type credentialRevoker interface {
+	// OnRevoke registers a function which is called with every revoked user.
+	// Calling the returned function unregisters it.
+	OnRevoke(fn func(user, reason string)) (unregister func())
+}
+
+// revokeListeners holds the functions registered with OnRevoke. The zero value is ready to use.
+type revokeListeners struct {
+	mu     sync.Mutex
+	nextID uint64
+	fns    map[uint64]func(user, reason string)
+}
+
+// add registers fn and returns a function which unregisters it.
+func (r *revokeListeners) add(fn func(user, reason string)) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fns == nil {
+		r.fns = make(map[uint64]func(user, reason string))
+	}
+	r.nextID++
+	id := r.nextID
+	r.fns[id] = fn
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.fns, id)
+	}
+}
+
+// notify calls the registered functions with a revoked user.
+func (r *revokeListeners) notify(user, reason string) {
+	r.mu.Lock()
+	fns := make([]func(user, reason string), 0, len(r.fns))
+	for _, fn := range r.fns {
+		fns = append(fns, fn)
+	}
+	r.mu.Unlock()
+	for _, fn := range fns {
+		fn(user, reason)
+	}
+}
+
+// Session describes an authenticated client connection and the requests it carries.
+type Session struct {
+	// ID identifies the session within its server.
+	ID uint64
+
+	// User is the user name the client authenticated with, empty for "auth-less" mode.
+	User string
+
+	// AuthContext is the authentication state of the session.
+	AuthContext *AuthContext
+
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+
+	// Started is the time the session was authenticated.
+	Started time.Time
+
+	conn     net.Conn
+	logger   *log.Logger // Logger of the server, can be nil
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	reason   string
+}
+
+// newSession creates a session for a client connection served by a server logging to logger.
+func newSession(conn net.Conn, logger *log.Logger) *Session {
+	return &Session{
+		RemoteAddr: conn.RemoteAddr(),
+		conn:       conn,
+		logger:     logger,
+		done:       make(chan struct{}),
+	}
+}
+
+// logf logs to the logger of the server serving the session, if any.
+func (s *Session) logf(format string, v ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, v...)
+	}
+}
+
+// BytesIn returns the number of bytes received from the client, including relayed UDP payloads.
+func (s *Session) BytesIn() int64 {
+	return s.bytesIn.Load()
+}
+
+// BytesOut returns the number of bytes sent to the client, including relayed UDP payloads.
+func (s *Session) BytesOut() int64 {
+	return s.bytesOut.Load()
+}
+
+// Reason returns why the session ended, or an empty string while it is active.
+func (s *Session) Reason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// Done returns a channel that is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close terminates the session with the given reason. The client connection and all
+// associated relays are closed. Only the first reason is recorded.
+func (s *Session) Close(reason string) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.reason = reason
+		s.mu.Unlock()
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// addIn counts n bytes received from the client.
+func (s *Session) addIn(n int) {
+	if s != nil && n > 0 {
+		s.bytesIn.Add(int64(n))
+	}
+}
+
+// addOut counts n bytes sent to the client.
+func (s *Session) addOut(n int) {
+	if s != nil && n > 0 {
+		s.bytesOut.Add(int64(n))
+	}
+}
+
+// sessionConn is a client connection counting the bytes transferred for its session.
+type sessionConn struct {
+	net.Conn
+	session *Session
+}
+
+// Read reads from the client connection and counts the bytes received.
+func (c *sessionConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.session.addIn(n)
+	return n, err
+}
+
+// Write writes to the client connection and counts the bytes sent.
+func (c *sessionConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.session.addOut(n)
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the client connection, if supported.
+func (c *sessionConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// sessionTable tracks the active sessions of a server. The zero value is ready to use.
+type sessionTable struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*Session
+}
+
+// add registers a session and assigns its ID.
+func (t *sessionTable) add(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessions == nil {
+		t.sessions = make(map[uint64]*Session)
+	}
+	t.nextID++
+	s.ID = t.nextID
+	t.sessions[s.ID] = s
+}
+
+// remove unregisters a session.
+func (t *sessionTable) remove(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, s.ID)
+}
+
+// list returns the active sessions matching filter, or all active sessions if filter is nil.
+func (t *sessionTable) list(filter func(*Session) bool) []*Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*Session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		if filter == nil || filter(s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Sessions returns the active sessions of the server.
+func (s *Server) Sessions() []*Session {
+	return s.sessions.list(nil)
+}
+
+// RevokeUser closes all active sessions of user with the given reason and returns the number
+// of sessions closed. Open CONNECT and BIND tunnels and UDP associations of these sessions are terminated.
+func (s *Server) RevokeUser(user, reason string) int {
+	if reason == "" {
+		reason = ReasonRevoked
+	}
+	sessions := s.sessions.list(func(session *Session) bool {
+		return session.User != "" && session.User == user
+	})
+	for _, session := range sessions {
+		s.config.Logger.Printf("[INFO] socks: Revoking session %v of user %q from %v: %s", session.ID, user, session.RemoteAddr, reason)
+		session.Close(reason)
+	}
+	return len(sessions)
+}
+
+// RevokeSession closes the active session with the given ID and reason.
+// It returns false if no such session is active.
+func (s *Server) RevokeSession(id uint64, reason string) bool {
+	if reason == "" {
+		reason = ReasonRevoked
+	}
+	sessions := s.sessions.list(func(session *Session) bool {
+		return session.ID == id
+	})
+	for _, session := range sessions {
+		s.config.Logger.Printf("[INFO] socks: Revoking session %v from %v: %s", session.ID, session.RemoteAddr, reason)
+		session.Close(reason)
+	}
+	return len(sessions) != 0
+}
+
+// DynamicCredentials is a concurrency-safe implementation of the CredentialStore interface whose
+// users can be changed while the server is running. Removing a user or changing their password
+// terminates the active sessions of that user on every Server using the store.
+type DynamicCredentials struct {
+	mu        sync.RWMutex
+	users     map[string]string
+	listeners revokeListeners
+}
+
+// NewDynamicCredentials creates a DynamicCredentials holding a copy of users.
+func NewDynamicCredentials(users map[string]string) *DynamicCredentials {
+	d := &DynamicCredentials{users: make(map[string]string, len(users))}
+	for user, password := range users {
+		d.users[user] = password
+	}
+	return d
+}
+
+// Valid checks if the given user and password combination is valid.
+func (d *DynamicCredentials) Valid(user, password string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	pass, ok := d.users[user]
+	return ok && pass == password
+}
+
+// Set adds a user or changes their password. Sessions authenticated with a previous password are revoked.
+func (d *DynamicCredentials) Set(user, password string) {
+	d.mu.Lock()
+	old, found := d.users[user]
+	d.users[user] = password
+	d.mu.Unlock()
+	if found && old != password {
+		d.revoke(user, "password changed")
+	}
+}
+
+// Delete removes a user and revokes their sessions.
+func (d *DynamicCredentials) Delete(user string) {
+	d.mu.Lock()
+	_, found := d.users[user]
+	delete(d.users, user)
+	d.mu.Unlock()
+	if found {
+		d.revoke(user, "user removed")
+	}
+}
+
+// Replace reloads the store with a copy of users. Sessions of users which were removed
+// or whose password changed are revoked.
+func (d *DynamicCredentials) Replace(users map[string]string) {
+	next := make(map[string]string, len(users))
+	for user, password := range users {
+		next[user] = password
+	}
+
+	d.mu.Lock()
+	var removed, changed []string
+	for user, old := range d.users {
+		if password, found := next[user]; !found {
+			removed = append(removed, user)
+		} else if password != old {
+			changed = append(changed, user)
+		}
+	}
+	d.users = next
+	d.mu.Unlock()
+
+	for _, user := range removed {
+		d.revoke(user, "user removed")
+	}
+	for _, user := range changed {
+		d.revoke(user, "password changed")
+	}
+}
+
+// OnRevoke registers a function which is called with every revoked user, and returns a function
+// which unregisters it. Servers register themselves when they are created and unregister on Close.
+func (d *DynamicCredentials) OnRevoke(fn func(user, reason string)) (unregister func()) {
+	return d.listeners.add(fn)
+}
+
+// revoke notifies the listeners about a revoked user.
+func (d *DynamicCredentials) revoke(user, reason string) {
+	d.listeners.notify(user, reason)
+}
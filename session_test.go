@@ -0,0 +1,144 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAccounting struct {
+	mu      sync.Mutex
+	started []*Session
+	stopped chan *Session
+}
+
+func (a *testAccounting) SessionStart(s *Session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.started = append(a.started, s)
+}
+
+func (a *testAccounting) SessionStop(s *Session) {
+	a.stopped <- s
+}
+
+func TestSession_Revoke(t *testing.T) {
+	// Create a local echo listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Create a socks server with a reloadable credential store
+	creds := NewDynamicCredentials(map[string]string{"foo": "bar", "baz": "qux"})
+	acct := &testAccounting{stopped: make(chan *Session, 1)}
+	serv, _ := New(&Config{
+		Credentials: creds,
+		Accounting:  acct,
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+	sl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sl.Close()
+	go serv.Serve(sl)
+
+	conn, err := net.Dial("tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	req := bytes.NewBuffer(nil)
+	req.Write([]byte{5, 1, UserPassAuth})
+	req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
+	req.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	req.Write(port)
+	req.Write([]byte("ping"))
+	conn.Write(req.Bytes())
+
+	out := make([]byte, 2+2+10+4)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out[14:], []byte("ping")) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	sessions := serv.Sessions()
+	if len(sessions) != 1 || sessions[0].User != "foo" {
+		t.Fatalf("bad sessions: %v", sessions)
+	}
+
+	// Reloading without the user terminates the tunnel
+	creds.Replace(map[string]string{"baz": "qux"})
+	if _, err := conn.Read(out); err != io.EOF {
+		t.Fatalf("expect EOF after revocation, got %v", err)
+	}
+
+	select {
+	case s := <-acct.stopped:
+		if s.Reason() != "user removed" {
+			t.Fatalf("bad reason: %v", s.Reason())
+		}
+		if s.BytesIn() != int64(req.Len()) || s.BytesOut() < 4 {
+			t.Fatalf("bad counters: in %v, out %v", s.BytesIn(), s.BytesOut())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expect session stop")
+	}
+	if len(serv.Sessions()) != 0 {
+		t.Fatalf("expect no sessions")
+	}
+	if creds.Valid("foo", "bar") || !creds.Valid("baz", "qux") {
+		t.Fatalf("bad credentials after reload")
+	}
+}
+
+func TestSession_RevokeUnregister(t *testing.T) {
+	creds := NewDynamicCredentials(map[string]string{"foo": "bar"})
+	var revoked []string
+	unregister := creds.OnRevoke(func(user, reason string) {
+		revoked = append(revoked, user)
+	})
+	serv, err := New(&Config{Credentials: creds})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(creds.listeners.fns) != 2 {
+		t.Fatalf("expect the server to be registered")
+	}
+
+	// A closed server is no longer referenced by the store
+	serv.Close()
+	if len(creds.listeners.fns) != 1 {
+		t.Fatalf("expect the server to be unregistered")
+	}
+	creds.Delete("foo")
+	unregister()
+	creds.Set("foo", "bar")
+	creds.Delete("foo")
+	if len(revoked) != 1 || revoked[0] != "foo" {
+		t.Fatalf("bad revocations: %v", revoked)
+	}
+}
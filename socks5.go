@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"time"
 )
 
 const (
@@ -18,8 +19,15 @@ type Config struct {
 	// AuthMethods can be provided to implement custom authentication.
 	// By default, "auth-less" mode is enabled.
 	// For password-based auth use UserPassAuthenticator.
+	// The order of AuthMethods is the server's order of preference
+	// when a client offers several of them.
 	AuthMethods []Authenticator
 
+	// AuthPolicy can be provided to select the authentication methods permitted
+	// for a client, e.g. based on its source network. If not provided,
+	// all AuthMethods are permitted in the order they are configured.
+	AuthPolicy AuthPolicy
+
 	// If provided, username/password authentication is enabled,
 	// by appending a UserPassAuthenticator to AuthMethods. If not provided,
 	// and AuthMethods is nil, then "auth-less" mode is enabled.
@@ -38,9 +46,24 @@ type Config struct {
 	// Defaults to NoRewrite.
 	Rewriter AddressRewriter
 
-	// BindIP is used for bind or UDP associate.
+	// BindIP is the IP reported to clients of BIND and UDP ASSOCIATE requests.
+	// It is kept for compatibility, AdvertisedAddr takes precedence.
 	BindIP net.IP
 
+	// ListenIP is the IP that BIND and UDP ASSOCIATE requests listen on.
+	// Defaults to the local IP of the control connection, or the loopback address for control
+	// connections without an IP, e.g. on Unix domain sockets.
+	ListenIP net.IP
+
+	// ListenPorts is the range of ports that BIND and UDP ASSOCIATE requests listen on.
+	// Defaults to a random port chosen by the system. New rejects a range that is not within 1-65535.
+	ListenPorts PortRange
+
+	// AdvertisedAddr is the IP address or host name reported to clients of BIND and
+	// UDP ASSOCIATE requests, e.g. the external address of a server behind NAT.
+	// Defaults to BindIP, or the listening IP, or the local IP of the control connection.
+	AdvertisedAddr string
+
 	// Logger can be used to provide a custom log target.
 	// Defaults to stdout.
 	Logger *log.Logger
@@ -50,6 +73,62 @@ type Config struct {
 
 	// Mem is the memory allocator.
 	Mem MemMgr
+
+	// Accounting can be provided to track the start and end of sessions.
+	Accounting Accounting
+
+	// UDPFragmentSize is the maximum payload of a datagram relayed to a UDP ASSOCIATE client.
+	// Larger payloads are split into fragments, see RFC 1928 section 7.
+	// Zero disables fragmentation.
+	UDPFragmentSize int
+
+	// UDPReassemblyTimeout is the reassembly timer of fragmented datagrams from clients.
+	// Defaults to, and cannot be less than, 5 seconds.
+	UDPReassemblyTimeout time.Duration
+
+	// UDPReassemblyLimit is the maximum size of a reassembled datagram from a client.
+	// Sequences exceeding it are abandoned. Defaults to 65535 bytes.
+	UDPReassemblyLimit int
+
+	// BindAcceptTimeout is how long a BIND request waits for the incoming connection.
+	// Zero means no timeout.
+	BindAcceptTimeout time.Duration
+
+	// BindCallback can be provided to be notified of BIND requests, once the server listens
+	// for the incoming connection and once it is accepted.
+	BindCallback func(event BindEvent)
+
+	// BindMatchPort restricts the incoming connection of a BIND request to the port in DST.PORT,
+	// in addition to the IP in DST.ADDR. By default, any port of the IP is accepted.
+	BindMatchPort bool
+
+	// UDPSharedAddrs can be provided to let all UDP associations share the UDP ports
+	// listening on these addresses, e.g. ":1080", instead of binding a random port each.
+	// Datagrams are demultiplexed to their association by client address.
+	// The ports are opened on the first association and remain open until Server.Close.
+	UDPSharedAddrs []string
+
+	// UDPFullCone enables endpoint-independent mapping for UDP associations: all destinations
+	// of an association share one outbound socket, and datagrams from any remote are relayed
+	// to the client if the rules permit the remote as a destination. By default, each destination
+	// has a connected socket which only accepts replies from the destination.
+	UDPFullCone bool
+
+	// UDPAssociationIdleTimeout is how long a UDP association can be idle before it ends,
+	// along with its control connection. Zero means no timeout.
+	UDPAssociationIdleTimeout time.Duration
+
+	// UDPPeerIdleTimeout is how long a destination of a UDP association can be idle
+	// before its socket is closed. Defaults to 2 minutes, a negative value disables the expiry.
+	UDPPeerIdleTimeout time.Duration
+
+	// UDPMaxPeersPerAssociation is the maximum number of destinations of a UDP association.
+	// The least recently used destination is closed to make room for a new one. Zero means no limit.
+	UDPMaxPeersPerAssociation int
+
+	// UDPMaxPeers is the maximum number of destinations of all UDP associations of the server.
+	// The least recently used destination is closed to make room for a new one. Zero means no limit.
+	UDPMaxPeers int
 }
 
 // Server is responsible for accepting connections and handling
@@ -62,8 +141,29 @@ type Server struct {
 	// Authenticator implementations.
 	authMethods map[uint8]Authenticator
 
+	// authOrder lists the configured authentication methods in order of preference.
+	authOrder []uint8
+
 	// isIPAllowed is a function that determines whether an IP address is allowed to connect.
 	isIPAllowed func(net.IP) bool
+
+	// sessions tracks the active sessions.
+	sessions sessionTable
+
+	// stats holds the counters of the server.
+	stats serverStats
+
+	// udpPeers tracks the destinations of all UDP associations.
+	udpPeers udpPeerTable
+
+	// binds tracks the pending BIND listeners.
+	binds bindTable
+
+	// sharedUDP holds the UDP ports shared by the associations, see Config.UDPSharedAddrs.
+	sharedUDP sharedUdpPool
+
+	// unregister removes the server from the credential stores notifying it about revoked users.
+	unregister []func()
 }
 
 // New creates a new Server instance and potentially returns an error if the configuration is invalid.
@@ -83,6 +183,11 @@ type Server struct {
 //
 //	A new Server instance and any error that might have occurred.
 func New(conf *Config) (*Server, error) {
+	// Ensure the listening port range is usable if one is configured
+	if conf.ListenPorts != (PortRange{}) && !conf.ListenPorts.valid() {
+		return nil, fmt.Errorf("invalid listen port range %v", conf.ListenPorts)
+	}
+
 	// Ensure we have at least one authentication method enabled
 	if len(conf.AuthMethods) == 0 {
 		if conf.Credentials != nil {
@@ -117,9 +222,28 @@ func New(conf *Config) (*Server, error) {
 
 	// Populate the authentication methods map with the configured authenticators.
 	for _, a := range conf.AuthMethods {
+		if _, found := server.authMethods[a.GetCode()]; !found {
+			server.authOrder = append(server.authOrder, a.GetCode())
+		}
 		server.authMethods[a.GetCode()] = a
 	}
 
+	// Terminate the sessions of users revoked by their credential store.
+	for _, a := range conf.AuthMethods {
+		var store CredentialStore
+		switch cator := a.(type) {
+		case UserPassAuthenticator:
+			store = cator.Credentials
+		case *UserPassAuthenticator:
+			store = cator.Credentials
+		}
+		if revoker, ok := store.(credentialRevoker); ok {
+			server.unregister = append(server.unregister, revoker.OnRevoke(func(user, reason string) {
+				server.RevokeUser(user, reason)
+			}))
+		}
+	}
+
 	// Set a default IP allowlist function that allows all IPs.
 	server.isIPAllowed = func(ip net.IP) bool {
 		return true // By default, allow all IPs
@@ -145,6 +269,16 @@ func (s *Server) SetIPAllowlist(allowedIPs []net.IP) {
 	}
 }
 
+// Close unregisters the server from the credential stores of its authentication methods, so that a
+// store outliving the server no longer references it, and closes the shared UDP ports, see
+// Config.UDPSharedAddrs. Listeners passed to Serve and active sessions are not closed, see RevokeSession.
+func (s *Server) Close() error {
+	for _, unregister := range s.unregister {
+		unregister()
+	}
+	return s.sharedUDP.close()
+}
+
 // ListenAndServe creates a listener on the specified network address and starts serving connections.
 // It is a convenience function that calls net.Listen and then Serve.
 //
@@ -186,22 +320,27 @@ func (s *Server) Serve(l net.Listener) error {
 //   - Processes the client's request and sends the appropriate response.
 //
 // ServeConn returns an error if any step fails.
-func (s *Server) ServeConn(conn net.Conn) error {
-	defer conn.Close()
+func (s *Server) ServeConn(conn net.Conn) (err error) {
+	session := newSession(conn, s.config.Logger)
+	defer session.Close(ReasonClientClosed)
+	metaConn := conn
+	conn = &sessionConn{Conn: conn, session: session}
 	bufConn := bufio.NewReader(conn)
 
-	// Check client IP against allowlist
-	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-	if err != nil {
-		s.config.Logger.Printf("[ERR] socks: Failed to get client IP address: %v", err)
-		return err
-	}
-	ip := net.ParseIP(clientIP)
-	if s.isIPAllowed(ip) {
-		s.config.Logger.Printf("[INFO] socks: Connection from allowed IP address: %s", clientIP)
-	} else {
-		s.config.Logger.Printf("[WARN] socks: Connection from not allowed IP address: %s", clientIP)
-		return fmt.Errorf("connection from not allowed IP address")
+	// Check client IP against allowlist, clients on Unix domain sockets have no IP to check
+	if !isUnixAddr(conn.LocalAddr()) {
+		ip := addrIP(conn.RemoteAddr())
+		if ip == nil {
+			err := fmt.Errorf("failed to get client IP address from %v", conn.RemoteAddr())
+			s.config.Logger.Printf("[ERR] socks: %v", err)
+			return err
+		}
+		if s.isIPAllowed(ip) {
+			s.config.Logger.Printf("[INFO] socks: Connection from allowed IP address: %s", ip)
+		} else {
+			s.config.Logger.Printf("[WARN] socks: Connection from not allowed IP address: %s", ip)
+			return fmt.Errorf("connection from not allowed IP address")
+		}
 	}
 
 	// Read the version byte
@@ -219,12 +358,47 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 
 	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
+	authContext, err := s.authenticate(context.Background(), newConnMetadata(metaConn), conn, bufConn)
 	if err != nil {
 		err = fmt.Errorf("failed to authenticate: %v", err)
 		s.config.Logger.Printf("[ERR] socks: %v", err)
 		return err
 	}
+	if !authContext.Expires.IsZero() && !time.Now().Before(authContext.Expires) {
+		err := fmt.Errorf("credentials expired at %v", authContext.Expires)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+
+	// Register the session, so it can be listed and revoked
+	session.AuthContext = authContext
+	session.User = authContext.Payload["Username"]
+	session.Started = time.Now()
+	s.sessions.add(session)
+	if s.config.Accounting != nil {
+		s.config.Accounting.SessionStart(session)
+	}
+	defer func() {
+		if err != nil {
+			session.Close(err.Error())
+		} else {
+			session.Close(ReasonClientClosed)
+		}
+		s.sessions.remove(session)
+		s.config.Logger.Printf("[INFO] socks: Session %v of %v ended: %s", session.ID, session.RemoteAddr, session.Reason())
+		if s.config.Accounting != nil {
+			s.config.Accounting.SessionStop(session)
+		}
+	}()
+
+	// End the session when the credentials expire
+	if !authContext.Expires.IsZero() {
+		timer := time.AfterFunc(time.Until(authContext.Expires), func() {
+			s.config.Logger.Printf("[INFO] socks: Session %v of %v expired", session.ID, session.RemoteAddr)
+			session.Close(ReasonExpired)
+		})
+		defer timer.Stop()
+	}
 
 	// Read the client's request
 	request, err := NewRequest(bufConn)
@@ -237,6 +411,7 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return fmt.Errorf("failed to read destination address: %v", err)
 	}
 	request.AuthContext = authContext
+	request.session = session
 	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
 		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
 	}
@@ -250,3 +425,22 @@ func (s *Server) ServeConn(conn net.Conn) error {
 
 	return nil
 }
+
+// addrIP returns the IP address of addr, or nil if addr has no IP address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -1,7 +1,14 @@
 package socks5
 
 import (
+	"fmt"
 	"net"
+	"sync"
+)
+
+const (
+	// sharedUdpQueueLen is the number of datagrams queued for an association on a shared port.
+	sharedUdpQueueLen = 64
 )
 
 // udpServer is a global instance of UdpServer.
@@ -13,8 +20,22 @@ func UdpInstance() *UdpServer {
 }
 
 // UdpServer represents a UDP server that can handle UDP connections.
+// It either owns its UDP connection, or receives the datagrams of one association
+// from a UDP port shared by several associations, see Config.UDPSharedAddrs.
 type UdpServer struct {
 	ls *net.UDPConn // The underlying UDP connection.
+
+	shared *sharedUdpPort    // The shared port, nil if the server owns ls.
+	source *udpSourceFilter  // The client of the association on a shared port.
+	in     chan sharedPacket // Datagrams demultiplexed from the shared port.
+	done   chan struct{}     // Closed when the server is closed.
+	once   sync.Once
+}
+
+// sharedPacket is a datagram received on a shared port.
+type sharedPacket struct {
+	data []byte
+	from *net.UDPAddr
 }
 
 // newUdpServer creates and returns a new UdpServer instance.
@@ -36,12 +57,29 @@ func (us *UdpServer) Listen(network, addr string) error {
 // ReadFromUdp reads a UDP packet from the underlying UDP connection.
 // It returns the number of bytes read, the remote address from which the packet was received, and any error encountered.
 func (us *UdpServer) ReadFromUdp(bs []byte) (int, *net.UDPAddr, error) {
-	return us.ls.ReadFromUDP(bs)
+	if us.shared == nil {
+		return us.ls.ReadFromUDP(bs)
+	}
+	select {
+	case p := <-us.in:
+		return copy(bs, p.data), p.from, nil
+	case <-us.done:
+		return 0, nil, net.ErrClosed
+	case <-us.shared.done:
+		return 0, nil, net.ErrClosed
+	}
 }
 
 // WriteToUDP writes a UDP packet to the specified remote address.
 // It returns the number of bytes written and any error encountered.
 func (us *UdpServer) WriteToUDP(bs []byte, addr *net.UDPAddr) (int, error) {
+	if us.shared != nil {
+		select {
+		case <-us.done:
+			return 0, net.ErrClosed
+		default:
+		}
+	}
 	return us.ls.WriteToUDP(bs, addr)
 }
 
@@ -52,6 +90,189 @@ func (us *UdpServer) LocalAddr() net.Addr {
 
 // Close closes the UDP connection.
 // It returns an error if the connection cannot be closed.
+// A server on a shared port only stops receiving datagrams, the shared port remains open.
 func (us *UdpServer) Close() error {
-	return us.ls.Close()
-}
\ No newline at end of file
+	if us.shared == nil {
+		return us.ls.Close()
+	}
+	us.once.Do(func() {
+		us.shared.unregister(us)
+		close(us.done)
+	})
+	return nil
+}
+
+// sharedUdpPort is a UDP port shared by several associations.
+// Datagrams are demultiplexed to the association of their client, see dispatch.
+type sharedUdpPort struct {
+	ls      *net.UDPConn
+	dropped func()        // Called for every datagram without an association
+	done    chan struct{} // Closed when serve returned
+
+	mu     sync.Mutex
+	assocs []*UdpServer          // Associations in order of creation
+	byAddr map[string]*UdpServer // Associations by learned client address
+}
+
+// listenSharedUdpPort opens a shared port on addr and starts demultiplexing its datagrams.
+func listenSharedUdpPort(addr string, dropped func()) (*sharedUdpPort, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ls, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &sharedUdpPort{
+		ls:      ls,
+		dropped: dropped,
+		done:    make(chan struct{}),
+		byAddr:  make(map[string]*UdpServer),
+	}
+	go p.serve()
+	return p, nil
+}
+
+// register creates the UdpServer of an association whose client is described by source.
+func (p *sharedUdpPort) register(source *udpSourceFilter) *UdpServer {
+	us := &UdpServer{
+		ls:     p.ls,
+		shared: p,
+		source: source,
+		in:     make(chan sharedPacket, sharedUdpQueueLen),
+		done:   make(chan struct{}),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.assocs = append(p.assocs, us)
+	return us
+}
+
+// unregister removes an association from the port.
+func (p *sharedUdpPort) unregister(us *UdpServer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, v := range p.assocs {
+		if v == us {
+			p.assocs = append(p.assocs[:i], p.assocs[i+1:]...)
+			break
+		}
+	}
+	for k, v := range p.byAddr {
+		if v == us {
+			delete(p.byAddr, k)
+		}
+	}
+}
+
+// load returns the number of associations on the port.
+func (p *sharedUdpPort) load() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.assocs)
+}
+
+// dispatch returns the association of a datagram from addr, or nil if there is none.
+// A client address seen before belongs to the association that learned it. Otherwise the
+// datagram belongs to the oldest association whose client may send from addr, e.g. the oldest
+// association from the same IP that has not learned the port of its client yet.
+func (p *sharedUdpPort) dispatch(addr *net.UDPAddr) *UdpServer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if us, ok := p.byAddr[addr.String()]; ok {
+		return us
+	}
+	for _, us := range p.assocs {
+		if us.source.accept(addr) {
+			p.byAddr[addr.String()] = us
+			return us
+		}
+	}
+	return nil
+}
+
+// serve demultiplexes the datagrams of the port until it is closed.
+func (p *sharedUdpPort) serve() {
+	defer close(p.done)
+	bs := make([]byte, 65536)
+	for {
+		n, from, err := p.ls.ReadFromUDP(bs)
+		if err != nil {
+			return
+		}
+		us := p.dispatch(from)
+		if us == nil {
+			p.dropped()
+			continue
+		}
+		data := make([]byte, n)
+		copy(data, bs[:n])
+		select {
+		case us.in <- sharedPacket{data: data, from: from}:
+		case <-us.done:
+		default:
+			// The association is not keeping up, drop the datagram like a full socket buffer would
+		}
+	}
+}
+
+// Close closes the port and waits for serve to return.
+// The associations on the port stop receiving datagrams.
+func (p *sharedUdpPort) Close() error {
+	err := p.ls.Close()
+	<-p.done
+	return err
+}
+
+// sharedUdpPool holds the shared ports of a server, which are opened on first use.
+// The zero value is ready to use.
+type sharedUdpPool struct {
+	mu     sync.Mutex
+	ports  []*sharedUdpPort
+	closed bool // Set by close
+}
+
+// acquire registers an association on the least loaded shared port.
+func (pool *sharedUdpPool) acquire(s *Server, source *udpSourceFilter) (*UdpServer, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		return nil, fmt.Errorf("shared UDP ports: %w", net.ErrClosed)
+	}
+	if pool.ports == nil {
+		for _, addr := range s.config.UDPSharedAddrs {
+			p, err := listenSharedUdpPort(addr, func() { s.stats.udpSpoofedDropped.Add(1) })
+			if err != nil {
+				for _, p := range pool.ports {
+					p.Close()
+				}
+				pool.ports = nil
+				return nil, fmt.Errorf("failed to listen on shared UDP address %v: %v", addr, err)
+			}
+			pool.ports = append(pool.ports, p)
+		}
+	}
+	var port *sharedUdpPort
+	for _, p := range pool.ports {
+		if port == nil || p.load() < port.load() {
+			port = p
+		}
+	}
+	return port.register(source), nil
+}
+
+// close closes the shared ports. Associations can no longer be acquired afterwards.
+func (pool *sharedUdpPool) close() error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.closed = true
+	var err error
+	for _, p := range pool.ports {
+		if cerr := p.Close(); err == nil {
+			err = cerr
+		}
+	}
+	pool.ports = nil
+	return err
+}
@@ -0,0 +1,271 @@
+package socks5
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultWebhookTimeout is the timeout of a webhook request if none is configured.
+	defaultWebhookTimeout = 5 * time.Second
+
+	// defaultWebhookCacheSize is the maximum number of cached responses if none is configured.
+	defaultWebhookCacheSize = 4096
+)
+
+// WebhookRequest is the JSON body POSTed to the webhook for every credential check.
+type WebhookRequest struct {
+	// Username is the user name sent by the client.
+	Username string `json:"username"`
+
+	// Password is the password sent by the client.
+	Password string `json:"password"`
+
+	// RemoteAddr is the address of the client, if known.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// LocalAddr is the address of the listener the client connected to, if known.
+	LocalAddr string `json:"local_addr,omitempty"`
+}
+
+// WebhookResponse is the JSON body expected from the webhook.
+type WebhookResponse struct {
+	// Allow specifies whether the credentials are valid.
+	Allow bool `json:"allow"`
+
+	// Identity optionally names the authenticated identity.
+	// It is stored as "Identity" in the AuthContext payload.
+	Identity string `json:"identity,omitempty"`
+
+	// Attributes are optional identity attributes which are added to the AuthContext payload.
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// WebhookCredentials is an implementation of the CredentialStore and CredentialVerifier interfaces
+// which validates user credentials by POSTing a WebhookRequest to an HTTP endpoint.
+// The endpoint answers with status 200 and a WebhookResponse, any other status is treated as an error.
+//
+// Successful and failed checks can be cached to reduce the load on the endpoint. Errors reaching
+// the endpoint are never cached, they either deny or allow the client depending on FailOpen.
+//
+// A WebhookCredentials must not be copied after first use.
+type WebhookCredentials struct {
+	// URL is the endpoint the credentials are POSTed to.
+	URL string
+
+	// Client is the HTTP client used for requests.
+	// Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Header contains additional headers sent with every request, e.g. for authorization.
+	Header http.Header
+
+	// Timeout is the maximum amount of time a request may take.
+	// Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// SuccessTTL is how long a successful check is cached. Zero disables caching.
+	SuccessTTL time.Duration
+
+	// FailureTTL is how long a failed check is cached. Zero disables caching.
+	FailureTTL time.Duration
+
+	// CacheSize is the maximum number of cached responses. Failed checks are evicted first,
+	// oldest first. Defaults to 4096.
+	CacheSize int
+
+	// FailOpen specifies whether clients are allowed when the endpoint cannot be reached
+	// or returns an invalid response. By default such clients are denied.
+	FailOpen bool
+
+	mu        sync.Mutex
+	cache     map[string]*list.Element // Cached responses by key, values are *webhookCacheEntry
+	successes list.List                // Successful checks, oldest at the back
+	failures  list.List                // Failed checks, oldest at the back
+}
+
+// webhookCacheEntry is a cached webhook response.
+type webhookCacheEntry struct {
+	key     string
+	resp    *WebhookResponse
+	expires time.Time
+}
+
+// Valid checks if the given user and password combination is valid.
+// It is equivalent to VerifyCredentials without connection metadata.
+func (w *WebhookCredentials) Valid(user, password string) bool {
+	_, err := w.VerifyCredentials(context.Background(), nil, user, password)
+	return err == nil
+}
+
+// VerifyCredentials checks the user and password with the webhook, or with the cache if a previous
+// response is still valid. The identity and attributes of the response are returned in the payload
+// of the AuthContext.
+func (w *WebhookCredentials) VerifyCredentials(ctx context.Context, meta *ConnMetadata, user, password string) (*AuthContext, error) {
+	req := &WebhookRequest{Username: user, Password: password}
+	key := user + "\x00" + password
+	if meta != nil {
+		if meta.RemoteAddr != nil {
+			req.RemoteAddr = meta.RemoteAddr.String()
+			// Decisions may depend on the client, so cache them per client IP
+			if ip := addrIP(meta.RemoteAddr); ip != nil {
+				key += "\x00" + ip.String()
+			}
+		}
+		if meta.LocalAddr != nil {
+			req.LocalAddr = meta.LocalAddr.String()
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	key = hex.EncodeToString(sum[:])
+
+	resp, ok := w.lookup(key)
+	if !ok {
+		var err error
+		resp, err = w.call(ctx, req)
+		if err != nil {
+			if !w.FailOpen {
+				return nil, err
+			}
+			resp = &WebhookResponse{Allow: true}
+		} else {
+			w.store(key, resp)
+		}
+	}
+
+	if !resp.Allow {
+		return nil, errUserAuthFailed
+	}
+	payload := make(map[string]string, len(resp.Attributes)+1)
+	for k, v := range resp.Attributes {
+		payload[k] = v
+	}
+	if resp.Identity != "" {
+		payload["Identity"] = resp.Identity
+	}
+	return &AuthContext{Method: UserPassAuth, Payload: payload}, nil
+}
+
+// call POSTs the request to the webhook and decodes the response.
+func (w *WebhookCredentials) call(ctx context.Context, req *WebhookRequest) (*WebhookResponse, error) {
+	timeout := w.Timeout
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range w.Header {
+		httpReq.Header[k] = v
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("webhook request failed: %v", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, httpResp.Body)
+		return nil, fmt.Errorf("webhook returned status %v", httpResp.Status)
+	}
+	resp := new(WebhookResponse)
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook response: %v", err)
+	}
+	return resp, nil
+}
+
+// lookup returns the cached response for key if it has not expired.
+func (w *WebhookCredentials) lookup(key string) (*WebhookResponse, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	elem, ok := w.cache[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*webhookCacheEntry)
+	if time.Now().After(entry.expires) {
+		w.removeLocked(elem)
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+// store caches the response for key according to the configured TTLs.
+// Expired entries are purged and the cache is kept within CacheSize, evicting failed checks first.
+func (w *WebhookCredentials) store(key string, resp *WebhookResponse) {
+	ttl := w.FailureTTL
+	if resp.Allow {
+		ttl = w.SuccessTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	size := w.CacheSize
+	if size <= 0 {
+		size = defaultWebhookCacheSize
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	if w.cache == nil {
+		w.cache = make(map[string]*list.Element)
+	}
+	if elem, ok := w.cache[key]; ok {
+		w.removeLocked(elem)
+	}
+	// Entries of a list are ordered by expiry, so only the oldest ones need to be checked
+	for _, l := range []*list.List{&w.failures, &w.successes} {
+		for l.Len() > 0 && now.After(l.Back().Value.(*webhookCacheEntry).expires) {
+			w.removeLocked(l.Back())
+		}
+	}
+
+	l := &w.failures
+	if resp.Allow {
+		l = &w.successes
+	}
+	w.cache[key] = l.PushFront(&webhookCacheEntry{key: key, resp: resp, expires: now.Add(ttl)})
+	for len(w.cache) > size {
+		if w.failures.Len() > 0 {
+			w.removeLocked(w.failures.Back())
+		} else {
+			w.removeLocked(w.successes.Back())
+		}
+	}
+}
+
+// removeLocked removes a cached entry, w.mu must be held.
+func (w *WebhookCredentials) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*webhookCacheEntry)
+	delete(w.cache, entry.key)
+	if entry.resp.Allow {
+		w.successes.Remove(elem)
+	} else {
+		w.failures.Remove(elem)
+	}
+}
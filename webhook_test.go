@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookCredentials(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := WebhookResponse{Allow: req.Username == "foo" && req.Password == "bar"}
+		if resp.Allow {
+			resp.Identity = "foo@example.com"
+			resp.Attributes = map[string]string{"Remote": req.RemoteAddr}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	creds := &WebhookCredentials{
+		URL:        ts.URL,
+		Header:     http.Header{"Authorization": []string{"Bearer secret"}},
+		SuccessTTL: time.Minute,
+		FailureTTL: time.Minute,
+	}
+	meta := &ConnMetadata{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}
+
+	ctx, err := creds.VerifyCredentials(context.Background(), meta, "foo", "bar")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ctx.Payload["Identity"] != "foo@example.com" || ctx.Payload["Remote"] != "10.0.0.1:1234" {
+		t.Fatalf("bad payload: %v", ctx.Payload)
+	}
+	if _, err := creds.VerifyCredentials(context.Background(), meta, "foo", "baz"); err != errUserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Both results are cached
+	creds.VerifyCredentials(context.Background(), meta, "foo", "bar")
+	creds.VerifyCredentials(context.Background(), meta, "foo", "baz")
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 webhook calls, got %v", n)
+	}
+}
+
+func TestWebhookCredentials_FailPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	creds := &WebhookCredentials{URL: ts.URL, Timeout: 10 * time.Millisecond}
+	if creds.Valid("foo", "bar") {
+		t.Fatalf("expect fail-closed")
+	}
+
+	creds.FailOpen = true
+	if !creds.Valid("foo", "bar") {
+		t.Fatalf("expect fail-open")
+	}
+}
+
+func TestWebhookCredentials_CacheSize(t *testing.T) {
+	creds := &WebhookCredentials{SuccessTTL: time.Minute, FailureTTL: time.Minute, CacheSize: 8}
+	creds.store("good", &WebhookResponse{Allow: true})
+
+	// A burst of bad credentials evicts failed checks first
+	for i := 0; i < 100; i++ {
+		creds.store(fmt.Sprintf("bad-%v", i), &WebhookResponse{})
+	}
+	if n := len(creds.cache); n != 8 {
+		t.Fatalf("expect 8 cached entries, got %v", n)
+	}
+	if _, ok := creds.lookup("good"); !ok {
+		t.Fatalf("expect successful check to stay cached")
+	}
+	if _, ok := creds.lookup("bad-0"); ok {
+		t.Fatalf("expect oldest failed check to be evicted")
+	}
+	if _, ok := creds.lookup("bad-99"); !ok {
+		t.Fatalf("expect newest failed check to be cached")
+	}
+
+	// Expired entries are purged
+	creds = &WebhookCredentials{SuccessTTL: time.Minute, FailureTTL: 10 * time.Millisecond}
+	creds.store("bad-1", &WebhookResponse{})
+	creds.store("bad-2", &WebhookResponse{})
+	time.Sleep(20 * time.Millisecond)
+	creds.store("good", &WebhookResponse{Allow: true})
+	if n := len(creds.cache); n != 1 {
+		t.Fatalf("expect expired entries to be purged, got %v entries", n)
+	}
+}